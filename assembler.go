@@ -0,0 +1,179 @@
+package netshovel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// An Assembler reassembles TCP streams, and tracks UDP flows, from packets
+//
+// This wraps a tcpassembly.Assembler,
+// so that Streams can find out about the packets they were built from.
+// Use NewAssembler to make one.
+type Assembler struct {
+	*tcpassembly.Assembler
+
+	// Tunnels lists the kinds of tunnel unwrapped to get at the TCP inside.
+	// NewAssembler sets this to AllTunnels.
+	Tunnels Tunnel
+
+	// Defragmenter puts fragmented IP packets back together before reassembly.
+	// NewAssembler sets this up with NewDefragmenter;
+	// set it to nil to ignore fragments.
+	Defragmenter *Defragmenter
+
+	// UDPFactory makes streams for UDP flows.
+	// NewAssembler sets this if its factory is also a UDPStreamFactory;
+	// if it's nil, UDP is ignored.
+	UDPFactory UDPStreamFactory
+
+	// Midstream starts TCP streams on their first packet with data,
+	// instead of waiting for a SYN that might never show up.
+	// Without this, streams missing their SYN are held until they're flushed,
+	// or until MaxBufferedPagesPerConnection is reached.
+	// This only works for streams built on a Stream.
+	Midstream bool
+
+	// StreamDepth is how many Utterances a Stream can hold before its decoder falls behind.
+	// Zero means DefaultStreamDepth.
+	StreamDepth int
+
+	// StreamBudget is how many bytes a Stream can hold before its decoder falls behind.
+	// Zero means there's no limit.
+	StreamBudget int
+
+	// BufferBudget is how many bytes all of this Assembler's Streams together
+	// can hold before decoders fall behind.
+	// Zero means there's no limit.
+	BufferBudget int
+
+	// Backpressure is what happens when a decoder falls behind.
+	// These buffering settings are fixed for each Stream when it's made,
+	// and BufferBudget when the first one is,
+	// so set them before assembling any packets.
+	Backpressure Backpressure
+
+	udp           udpTracker
+	conversations map[flowKey]*Conversation
+	packet        gopacket.Packet         // The packet currently being assembled
+	transport     gopacket.TransportLayer // The current packet's TCP or UDP layer
+	outer         []Encapsulation         // Tunnels the current packet was unwrapped from
+	decoders      sync.WaitGroup          // Streams whose decoders haven't finished
+	closing       CloseReason             // Why streams are being closed right now, if it's not up to the packet
+	buffer        *buffer                 // How much is waiting for decoders
+}
+
+// NewAssembler returns a new Assembler which sends streams to whatever is returned from factory
+func NewAssembler(factory tcpassembly.StreamFactory) *Assembler {
+	assembler := &Assembler{
+		Tunnels:      AllTunnels,
+		Defragmenter: NewDefragmenter(),
+	}
+	if udp, ok := factory.(UDPStreamFactory); ok {
+		assembler.UDPFactory = udp
+	}
+	streamPool := tcpassembly.NewStreamPool(&streamFactory{factory, assembler})
+	assembler.Assembler = tcpassembly.NewAssembler(streamPool)
+	return assembler
+}
+
+// AssemblePacket sends a packet to the assembler, if it's TCP or UDP
+//
+// Fragmented IP packets are held until they can be put back together.
+// TCP or UDP inside any of a.Tunnels is unwrapped first,
+// and reassembled using the inner addresses.
+// UDP is only tracked if a.UDPFactory is set.
+func (a *Assembler) AssemblePacket(packet gopacket.Packet) {
+	ls := packet.Layers()
+	when := packet.Metadata().Timestamp
+	if a.Defragmenter != nil {
+		ls = a.Defragmenter.Defragment(ls, when)
+	}
+	net, transport, outer := decapsulate(ls, a.Tunnels)
+
+	a.packet, a.transport, a.outer = packet, transport, outer
+	switch t := transport.(type) {
+	case *layers.TCP:
+		key := flowKey{net.NetworkFlow(), t.TransportFlow()}
+		if a.Midstream && !t.SYN && len(t.Payload) > 0 && a.streamOf(key) == nil {
+			a.pickUp(key, t, when)
+		}
+		a.AssembleWithTimestamp(key.net, t, when)
+		if stream := a.streamOf(key); stream != nil {
+			stream.observe(t)
+		}
+	case *layers.UDP:
+		if a.UDPFactory != nil {
+			a.trackUDP(net, t, when)
+		}
+	}
+	a.packet, a.transport, a.outer = nil, nil, nil
+}
+
+// pickUp starts a TCP stream partway through, as though t had followed a SYN
+func (a *Assembler) pickUp(key flowKey, t *layers.TCP, when time.Time) {
+	syn := *t
+	syn.BaseLayer = layers.BaseLayer{}
+	syn.SYN, syn.FIN, syn.RST = true, false, false
+	syn.Seq = t.Seq - 1
+	a.AssembleWithTimestamp(key.net, &syn, when)
+	if stream := a.streamOf(key); stream != nil {
+		stream.midstream = true
+	}
+}
+
+// FlushOlderThan flushes TCP streams and UDP flows which haven't seen a packet since t
+func (a *Assembler) FlushOlderThan(t time.Time) (flushed, closed int) {
+	a.closing = ClosedIdle
+	defer func() { a.closing = StillOpen }()
+	flushed, closed = a.Assembler.FlushOlderThan(t)
+	closed += a.flushUDP(t)
+	return flushed, closed
+}
+
+// FlushAll flushes every TCP stream and UDP flow,
+// and gives up on any fragmented packets still waiting to be put back together
+func (a *Assembler) FlushAll() (closed int) {
+	a.closing = ClosedEndOfCapture
+	defer func() { a.closing = StillOpen }()
+	if a.Defragmenter != nil {
+		a.Defragmenter.Flush()
+	}
+	return a.Assembler.FlushAll() + a.flushUDP(time.Time{})
+}
+
+// Wait waits for every decoder to finish with its Stream
+//
+// Decoders finish by reading to the end of their Stream,
+// or by calling Stream.Done.
+// Call this after FlushAll, or it may never return.
+func (a *Assembler) Wait() {
+	a.decoders.Wait()
+}
+
+// streamer is anything with a *Stream embedded in it
+type streamer interface {
+	netshovelStream() *Stream
+}
+
+func (stream *Stream) netshovelStream() *Stream {
+	return stream
+}
+
+// streamFactory introduces new Streams to their Assembler
+type streamFactory struct {
+	factory   tcpassembly.StreamFactory
+	assembler *Assembler
+}
+
+func (f *streamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	s := f.factory.New(net, transport)
+	if st, ok := s.(streamer); ok {
+		st.netshovelStream().attach(f.assembler)
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package netshovel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMidstream(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	packets := func() PacketSlice {
+		return PacketSlice{
+			withACK(tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 1000, false, []byte("hello"))),
+			withACK(tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 1005, false, []byte(" world"))),
+		}
+	}
+
+	for _, midstream := range []bool{false, true} {
+		factory := &testStreamFactory{streams: make(chan *Stream, 10), drain: true}
+		assembler := NewAssembler(factory)
+		assembler.Midstream = midstream
+		source := packets()
+		if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+			t.Fatal(err)
+		}
+		stream := <-factory.streams
+
+		bytes := 0
+		if midstream {
+			bytes = 11
+		}
+		if info := stream.Info(); info.Bytes != bytes {
+			t.Errorf("Midstream=%v: %d bytes before flushing", midstream, info.Bytes)
+		}
+		assembler.FlushAll()
+		assembler.Wait()
+		if n := buffered(assembler); n != 0 {
+			t.Errorf("Midstream=%v: %d bytes still counted as buffered", midstream, n)
+		}
+		if info := stream.Info(); info.Bytes != 11 {
+			t.Errorf("Midstream=%v: %d bytes after flushing", midstream, info.Bytes)
+		}
+		if !stream.Midstream() {
+			t.Errorf("Midstream=%v: stream didn't notice it started partway through", midstream)
+		}
+	}
+}
+
+func TestFlushOnGap(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	for _, maxPages := range []int{0, 1} {
+		source := handshake(t)[:3]
+		source = append(source,
+			withACK(tcpPacket(t, when.Add(2*time.Second), "10.0.0.1", "10.0.0.2", 1234, 80, 110, false, []byte("bye"))),
+		)
+		factory := &testStreamFactory{streams: make(chan *Stream, 10), drain: true}
+		assembler := NewAssembler(factory)
+		assembler.MaxBufferedPagesPerConnection = maxPages
+		if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+			t.Fatal(err)
+		}
+		client := <-factory.streams
+
+		missing := 0
+		if maxPages == 1 {
+			missing = 4
+		}
+		if info := client.Info(); info.Missing != missing {
+			t.Errorf("MaxPages=%d: %d bytes missing before flushing", maxPages, info.Missing)
+		}
+		if client.Midstream() {
+			t.Errorf("MaxPages=%d: stream with a handshake picked up partway through", maxPages)
+		}
+		assembler.FlushAll()
+		assembler.Wait()
+		if n := buffered(assembler); n != 0 {
+			t.Errorf("MaxPages=%d: %d bytes still counted as buffered", maxPages, n)
+		}
+	}
+}
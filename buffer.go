@@ -0,0 +1,299 @@
+package netshovel
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/dirtbags/netshovel/gapstring"
+)
+
+// A Backpressure policy says what happens when a decoder falls behind
+//
+// A decoder has fallen behind when it has Assembler.StreamDepth Utterances waiting to be read,
+// or when it has some waiting,
+// and more would put it over Assembler.StreamBudget or Assembler.BufferBudget.
+type Backpressure int
+
+// Backpressure policies
+const (
+	// Wait for the decoder to catch up.
+	// Every other stream waits too, so one stalled decoder stalls the whole capture.
+	BackpressureBlock Backpressure = iota
+
+	// Throw away the oldest waiting Utterance.
+	// The decoder sees a gap where its data used to be.
+	BackpressureDropOldest
+
+	// Throw away everything waiting, and everything to come.
+	// The decoder's next Read returns ErrDecoderTooSlow.
+	BackpressureAbort
+)
+
+// ErrDecoderTooSlow is returned by Read when a stream is thrown away under BackpressureAbort
+var ErrDecoderTooSlow = errors.New("Decoder fell too far behind")
+
+// DefaultStreamDepth is how many Utterances a Stream can hold before its decoder falls behind,
+// unless its Assembler says otherwise
+const DefaultStreamDepth = 100
+
+// A buffer keeps track of how much is waiting in every queue belonging to one Assembler
+//
+// Everything about how much is buffered is protected by its lock,
+// which is signalled whenever a decoder catches up a bit.
+type buffer struct {
+	lock   sync.Mutex
+	signal *sync.Cond
+	bytes  int // Bytes waiting in every queue
+	budget int // Most bytes that can be waiting, or 0 for no limit
+}
+
+func newBuffer(budget int) *buffer {
+	b := &buffer{budget: budget}
+	b.signal = sync.NewCond(&b.lock)
+	return b
+}
+
+// A queue holds Utterances until a decoder reads them
+//
+// A queue isn't ready until it's been set up,
+// which the Assembler does before sending anything to it.
+// Queues that never meet an Assembler are set up on their own,
+// with DefaultStreamDepth and no budget, as soon as they're used.
+type queue struct {
+	setup sync.Once
+	ready chan struct{} // Closed once the queue is set up
+
+	buf     *buffer
+	budget  int          // Most bytes this queue can hold, or 0 for no limit
+	policy  Backpressure // What happens when the decoder falls behind
+	c       chan Utterance
+	aborted chan struct{} // Closed under BackpressureAbort
+	bytes   int           // Bytes waiting to be read
+	lost    [3]int        // Bytes dropped under BackpressureDropOldest, by Direction
+}
+
+func newQueue() *queue {
+	return &queue{
+		ready:   make(chan struct{}),
+		aborted: make(chan struct{}),
+	}
+}
+
+// setUp gives q its limits, and where to count what's buffered, unless it already has them
+func (q *queue) setUp(buf *buffer, depth, budget int, policy Backpressure) {
+	q.setup.Do(func() {
+		q.buf = buf
+		q.budget = budget
+		q.policy = policy
+		q.c = make(chan Utterance, depth)
+		close(q.ready)
+	})
+}
+
+// alone sets q up on its own, if nothing else has
+func (q *queue) alone() {
+	if !closed(q.ready) {
+		q.setUp(newBuffer(0), DefaultStreamDepth, 0, BackpressureBlock)
+	}
+}
+
+// setUp gives q this Assembler's buffering limits
+func (a *Assembler) setUp(q *queue) {
+	if a.buffer == nil {
+		a.buffer = newBuffer(a.BufferBudget)
+	}
+	depth := a.StreamDepth
+	if depth < 1 {
+		depth = DefaultStreamDepth
+	}
+	q.setUp(a.buffer, depth, a.StreamBudget, a.Backpressure)
+}
+
+// behind returns true if adding n more bytes means the decoder has fallen behind
+//
+// You must hold q.buf.lock.
+func (q *queue) behind(n int) bool {
+	switch {
+	case len(q.c) == cap(q.c):
+		return true
+	case q.bytes == 0:
+		// It can always have something to work on
+		return false
+	case q.budget > 0 && q.bytes+n > q.budget:
+		return true
+	case q.buf.budget > 0 && q.buf.bytes+n > q.buf.budget:
+		return true
+	}
+	return false
+}
+
+// put sends u to the decoder, following q.policy if it's fallen behind
+//
+// If done is closed, u is thrown away.
+func (q *queue) put(u Utterance, done <-chan struct{}) {
+	q.alone()
+	n := u.Data.Length()
+
+	q.buf.lock.Lock()
+	for q.behind(n) && !closed(done) && !closed(q.aborted) {
+		if q.policy == BackpressureDropOldest && q.dropOldest() {
+			continue
+		} else if q.policy == BackpressureAbort {
+			close(q.aborted)
+			q.drain()
+			break
+		}
+		if len(q.c) == cap(q.c) {
+			// The channel will block for us
+			break
+		}
+		q.buf.signal.Wait()
+	}
+	if closed(q.aborted) {
+		q.buf.lock.Unlock()
+		q.buf.signal.Broadcast()
+		return
+	}
+	q.bytes += n
+	q.buf.bytes += n
+	q.buf.lock.Unlock()
+
+	select {
+	case q.c <- u:
+		q.wake()
+		if closed(done) {
+			// The decoder finished while we were sending
+			q.discard()
+		}
+	case <-done:
+		q.buf.lock.Lock()
+		q.bytes -= n
+		q.buf.bytes -= n
+		q.buf.lock.Unlock()
+		q.buf.signal.Broadcast()
+	}
+}
+
+// dropOldest throws away the oldest waiting Utterance, returning false if there wasn't one
+//
+// You must hold q.buf.lock.
+func (q *queue) dropOldest() bool {
+	select {
+	case u, more := <-q.c:
+		if !more {
+			return false
+		}
+		n := u.Data.Length()
+		q.bytes -= n
+		q.buf.bytes -= n
+		q.lost[u.Direction] += n
+		return true
+	default:
+		return false
+	}
+}
+
+// drain throws away every waiting Utterance
+//
+// You must hold q.buf.lock.
+func (q *queue) drain() {
+	for {
+		select {
+		case u, more := <-q.c:
+			if !more {
+				return
+			}
+			n := u.Data.Length()
+			q.bytes -= n
+			q.buf.bytes -= n
+		default:
+			return
+		}
+	}
+}
+
+// get returns the next Utterance for the decoder
+//
+// At the end, this returns io.EOF.
+// If the queue was thrown away under BackpressureAbort, this returns ErrDecoderTooSlow.
+func (q *queue) get() (Utterance, error) {
+	<-q.ready
+	q.buf.lock.Lock()
+	defer q.buf.signal.Broadcast()
+	defer q.buf.lock.Unlock()
+
+	// Receive with the lock held,
+	// so dropOldest can't throw away what comes next
+	// before we've settled what was lost ahead of this one
+	var u Utterance
+	var more bool
+	for waiting := true; waiting; {
+		if closed(q.aborted) {
+			return Utterance{}, ErrDecoderTooSlow
+		}
+		select {
+		case u, more = <-q.c:
+			waiting = false
+		default:
+			q.buf.signal.Wait()
+		}
+	}
+
+	if !more {
+		// Report anything dropped right at the end
+		for d, n := range q.lost {
+			if n > 0 {
+				q.lost[d] = 0
+				return Utterance{Data: gapstring.OfGap(n), Direction: Direction(d)}, nil
+			}
+		}
+		return Utterance{}, io.EOF
+	}
+
+	n := u.Data.Length()
+	q.bytes -= n
+	q.buf.bytes -= n
+	if lost := q.lost[u.Direction]; lost > 0 {
+		// Whatever was dropped came right before this
+		u.Data = gapstring.OfGap(lost).Append(u.Data)
+		u.Marks = shiftMarks(u.Marks, lost)
+		q.lost[u.Direction] = 0
+	}
+	return u, nil
+}
+
+// close tells the decoder nothing more is coming
+func (q *queue) close() {
+	q.alone()
+	close(q.c)
+	q.wake()
+}
+
+// wake lets a decoder waiting in get know q.c has changed
+func (q *queue) wake() {
+	q.buf.lock.Lock()
+	q.buf.signal.Broadcast()
+	q.buf.lock.Unlock()
+}
+
+// discard throws away everything waiting, once the decoder has finished
+//
+// The decoder must have closed the done channel passed to put before calling this.
+func (q *queue) discard() {
+	q.alone()
+	q.buf.lock.Lock()
+	q.drain()
+	q.buf.lock.Unlock()
+	q.buf.signal.Broadcast()
+}
+
+// closed returns true if c is closed
+func closed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
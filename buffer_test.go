@@ -0,0 +1,140 @@
+package netshovel
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// bufferedStream returns a Stream with assembler's buffer settings
+func bufferedStream(assembler *Assembler) *Stream {
+	stream := NewStream(gopacket.Flow{}, gopacket.Flow{})
+	assembler.setUp(stream.conversation)
+	return stream
+}
+
+// buffered returns how many bytes assembler's Streams are holding
+func buffered(assembler *Assembler) int {
+	if assembler.buffer == nil {
+		return 0
+	}
+	assembler.buffer.lock.Lock()
+	defer assembler.buffer.lock.Unlock()
+	return assembler.buffer.bytes
+}
+
+func TestBackpressure(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	assembler := NewAssembler(nil)
+
+	assembler.StreamDepth, assembler.StreamBudget, assembler.Backpressure = 2, 0, BackpressureDropOldest
+	stream := bufferedStream(assembler)
+	for _, s := range []string{"one", "two", "three", "four"} {
+		stream.Datagram(when, []byte(s))
+	}
+	stream.ReassemblyComplete()
+
+	u, err := stream.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := u.Data.String("?"); s != "??????three" {
+		t.Errorf("Dropped wrong: %q", s)
+	}
+	if u, err = stream.Read(-1); err != nil || u.Data.String("?") != "four" {
+		t.Errorf("Wrong second utterance: %q %v", u.Data.String("?"), err)
+	}
+
+	assembler.StreamDepth, assembler.StreamBudget, assembler.Backpressure = 100, 8, BackpressureDropOldest
+	stream = bufferedStream(assembler)
+	for _, s := range []string{"aaaa", "bbbb", "cccc"} {
+		stream.Datagram(when, []byte(s))
+	}
+	stream.ReassemblyComplete()
+
+	u, err = stream.Read(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := u.Data.String("?"); s != "????bbbbcccc" {
+		t.Errorf("Budget not enforced: %q", s)
+	}
+
+	assembler.StreamDepth, assembler.StreamBudget, assembler.Backpressure = 2, 0, BackpressureAbort
+	stream = bufferedStream(assembler)
+	for _, s := range []string{"one", "two", "three"} {
+		stream.Datagram(when, []byte(s))
+	}
+	stream.ReassemblyComplete()
+
+	if _, err := stream.Read(-1); err != ErrDecoderTooSlow {
+		t.Errorf("Expected ErrDecoderTooSlow, got %v", err)
+	}
+
+	if n := buffered(assembler); n != 0 {
+		t.Errorf("%d bytes still counted as buffered", n)
+	}
+}
+
+func TestBufferBudget(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	assembler := NewAssembler(nil)
+	assembler.BufferBudget, assembler.Backpressure = 8, BackpressureDropOldest
+
+	// Another Assembler's streams don't count
+	other := bufferedStream(NewAssembler(nil))
+	other.Datagram(when, []byte("elsewhere"))
+
+	a, b := bufferedStream(assembler), bufferedStream(assembler)
+	a.Datagram(when, []byte("aaaa"))
+	b.Datagram(when, []byte("bbbb"))
+	a.Datagram(when, []byte("cccc"))
+	a.ReassemblyComplete()
+	b.ReassemblyComplete()
+
+	if u, err := a.Read(100); err != nil || u.Data.String("?") != "????cccc" {
+		t.Errorf("Budget not enforced: %q %v", u.Data.String("?"), err)
+	}
+	if u, err := b.Read(100); err != nil || u.Data.String("?") != "bbbb" {
+		t.Errorf("Wrong stream dropped: %q %v", u.Data.String("?"), err)
+	}
+}
+
+func TestDropOldestOrder(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	assembler := NewAssembler(nil)
+	assembler.StreamDepth, assembler.StreamBudget, assembler.Backpressure = 2, 0, BackpressureDropOldest
+	stream := bufferedStream(assembler)
+
+	const count = 5000
+	go func() {
+		for i := 0; i < count; i++ {
+			stream.Datagram(when, []byte(fmt.Sprintf("%04d", i)))
+		}
+		stream.ReassemblyComplete()
+	}()
+
+	// Every Utterance has to land where it was sent, however many were dropped before it
+	pos := 0
+	for {
+		u, err := stream.conversation.get()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		s := u.Data.String("?")
+		i := strings.TrimLeft(s, "?")
+		if at := pos + len(s) - len(i); i != "" && i != fmt.Sprintf("%04d", at/4) {
+			t.Fatalf("%q landed at byte %d", i, at)
+		}
+		pos += len(s)
+	}
+	if pos != 4*count {
+		t.Errorf("Stream is %d bytes long", pos)
+	}
+}
@@ -0,0 +1,83 @@
+package netshovel
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// A compression format, recognized by its magic bytes
+type compression struct {
+	magic []byte
+	open  func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressions = []compression{
+	{
+		magic: []byte{0x1f, 0x8b},
+		open: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		open: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	{
+		magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		open: func(r io.Reader) (io.ReadCloser, error) {
+			x, err := xz.NewReader(r)
+			return ioutil.NopCloser(x), err
+		},
+	},
+	{
+		magic: []byte("BZh"),
+		open: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+}
+
+// decompress returns a reader of whatever r contains, decompressed if need be
+//
+// Compression is detected from magic bytes, not file names.
+// The returned reader must be closed when you're done,
+// but this doesn't close r.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	for _, c := range compressions {
+		magic, err := br.Peek(len(c.magic))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if bytes.Equal(magic, c.magic) {
+			return c.open(br)
+		}
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// closers closes a bunch of things, in order
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var ret error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
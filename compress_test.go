@@ -0,0 +1,77 @@
+package netshovel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func countPackets(t *testing.T, source PacketSource) int {
+	n := 0
+	for {
+		_, err := source.NextPacket()
+		if err == io.EOF {
+			return n
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
+func TestCompressedCaptures(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/hk.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := OpenReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := countPackets(t, source)
+
+	writers := map[string]func(io.Writer) (io.WriteCloser, error){
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"zstd": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		"xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+	}
+	for name, newWriter := range writers {
+		buf := new(bytes.Buffer)
+		w, err := newWriter(buf)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		w.Write(raw)
+		w.Close()
+
+		source, err := OpenReader(buf)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if n := countPackets(t, source); n != expected {
+			t.Errorf("%s: read %d packets, wanted %d", name, n, expected)
+		}
+		source.Close()
+	}
+
+	// There's no bzip2 compressor in the standard library
+	source, err = OpenFile("testdata/hk.pcap.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if n := countPackets(t, source); n != expected {
+		t.Errorf("bzip2: read %d packets, wanted %d", n, expected)
+	}
+}
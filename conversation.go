@@ -0,0 +1,286 @@
+package netshovel
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// A Direction says which half of a Conversation an Utterance came from
+type Direction int
+
+// Directions
+const (
+	UnknownDirection Direction = iota
+	FromClient
+	FromServer
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FromClient:
+		return "client→server"
+	case FromServer:
+		return "server→client"
+	}
+	return "unknown"
+}
+
+// A Role says which side of a Conversation a Stream comes from
+type Role int
+
+// Roles
+const (
+	UnknownRole Role = iota
+	ClientRole
+	ServerRole
+)
+
+func (r Role) String() string {
+	switch r {
+	case ClientRole:
+		return "client"
+	case ServerRole:
+		return "server"
+	}
+	return "unknown"
+}
+
+// opposite returns the Role of the other side
+func (r Role) opposite() Role {
+	switch r {
+	case ClientRole:
+		return ServerRole
+	case ServerRole:
+		return ClientRole
+	}
+	return UnknownRole
+}
+
+// guessRole guesses which side a stream comes from, by its port numbers
+//
+// Servers tend to use well-known ports,
+// and clients tend to use ephemeral ones.
+// When that doesn't help, the lower port is probably the server's.
+func guessRole(transport gopacket.Flow) Role {
+	switch transport.EndpointType() {
+	case layers.EndpointTCPPort, layers.EndpointUDPPort, layers.EndpointSCTPPort:
+	default:
+		return UnknownRole
+	}
+	src := binary.BigEndian.Uint16(transport.Src().Raw())
+	dst := binary.BigEndian.Uint16(transport.Dst().Raw())
+	switch {
+	case src == dst:
+		return UnknownRole
+	case (src < 1024) != (dst < 1024):
+		if src < 1024 {
+			return ServerRole
+		}
+		return ClientRole
+	case (src >= 49152) != (dst >= 49152):
+		if src >= 49152 {
+			return ClientRole
+		}
+		return ServerRole
+	case src < dst:
+		return ServerRole
+	}
+	return ClientRole
+}
+
+// ErrNotMerged is returned by Conversation.Read,
+// for Conversations which weren't made by a ConversationFactory
+var ErrNotMerged = errors.New("Conversation was not made by a ConversationFactory")
+
+// A Conversation is both halves of a two-way exchange
+//
+// The Assembler pairs up every Stream it builds,
+// so a decoder can always find the other half of its Stream.
+type Conversation struct {
+	// Handshake is true if the conversation began with a TCP handshake.
+	// If it didn't, the client and server were guessed from port numbers,
+	// or if even that didn't work, the client is whichever side was seen first.
+	Handshake bool
+
+	lock           sync.Mutex
+	client, server *Stream
+	open           int    // Halves which haven't finished
+	finished       bool   // The decoder called Done
+	utterances     *queue // Both halves, if made by a ConversationFactory
+}
+
+// Client returns the Stream from the client, or nil if the client hasn't said anything yet
+func (c *Conversation) Client() *Stream {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client
+}
+
+// Server returns the Stream from the server, or nil if the server hasn't said anything yet
+func (c *Conversation) Server() *Stream {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.server
+}
+
+// Other returns the other half of the conversation from stream, or nil if it hasn't shown up yet
+func (c *Conversation) Other(stream *Stream) *Stream {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if stream == c.client {
+		return c.server
+	}
+	return c.client
+}
+
+// Read returns the next Utterance from either half of the conversation
+//
+// Utterances are returned in the order they were reassembled,
+// which is the order they were captured,
+// and Utterance.Direction says which half each came from.
+// When both halves have finished, this returns io.EOF.
+// If your decoder fell behind and the Assembler's Backpressure is BackpressureAbort,
+// this returns ErrDecoderTooSlow.
+//
+// This only works for Conversations made by a ConversationFactory,
+// since otherwise each half goes to its own Stream.
+func (c *Conversation) Read() (Utterance, error) {
+	if c.utterances == nil {
+		return Utterance{}, ErrNotMerged
+	}
+	u, err := c.utterances.get()
+	if err != nil {
+		c.Done()
+	}
+	return u, err
+}
+
+// Done tells netshovel your decoder is finished with both halves of this Conversation
+//
+// Reading to the end of the Conversation does this for you.
+func (c *Conversation) Done() {
+	c.lock.Lock()
+	c.finished = true
+	client, server := c.client, c.server
+	c.lock.Unlock()
+	if client != nil {
+		client.Done()
+	}
+	if server != nil {
+		server.Done()
+	}
+	if c.utterances != nil {
+		c.utterances.discard()
+	}
+}
+
+// A ConversationFactory hands both halves of every conversation to the same decoder
+//
+// Pass one of these to Shovel instead of your own StreamFactory.
+// Decode is run in its own goroutine for each new Conversation,
+// and should Read until it gets io.EOF, or call Done.
+type ConversationFactory struct {
+	Decode func(conv *Conversation)
+}
+
+// New makes a Stream for one half of a TCP conversation
+func (f *ConversationFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	return f.newStream(net, transport)
+}
+
+// NewUDP makes a Stream for one half of a UDP conversation
+func (f *ConversationFactory) NewUDP(net, transport gopacket.Flow) UDPStream {
+	return f.newStream(net, transport)
+}
+
+func (f *ConversationFactory) newStream(net, transport gopacket.Flow) *Stream {
+	stream := NewStream(net, transport)
+	stream.decodeConversation = f.Decode
+	return stream
+}
+
+// pair finds the Conversation stream belongs to, starting a new one if need be
+//
+// It returns true if stream joined a Conversation its decoder is already Done with.
+func (a *Assembler) pair(stream *Stream) (late bool) {
+	if a.conversations == nil {
+		a.conversations = make(map[flowKey]*Conversation)
+	}
+	reverse := flowKey{stream.Net.Reverse(), stream.Transport.Reverse()}
+	if conv := a.conversations[reverse]; conv != nil && (conv.client == nil || conv.server == nil) {
+		conv.lock.Lock()
+		if conv.client == nil {
+			conv.client = stream
+			stream.direction = FromClient
+			stream.role = conv.server.role.opposite()
+		} else {
+			conv.server = stream
+			stream.direction = FromServer
+			stream.role = conv.client.role.opposite()
+		}
+		conv.open++
+		late = conv.finished
+		conv.lock.Unlock()
+		stream.conv = conv
+		a.conversations[flowKey{stream.Net, stream.Transport}] = conv
+		return late
+	}
+
+	conv := &Conversation{open: 1}
+	if tcp, ok := a.transport.(*layers.TCP); ok && tcp.SYN {
+		conv.Handshake = true
+		stream.role = ClientRole
+		if tcp.ACK {
+			stream.role = ServerRole
+		}
+	}
+	if stream.role == ServerRole {
+		conv.server = stream
+		stream.direction = FromServer
+	} else {
+		conv.client = stream
+		stream.direction = FromClient
+	}
+	stream.conv = conv
+	a.conversations[flowKey{stream.Net, stream.Transport}] = conv
+
+	if stream.decodeConversation != nil {
+		conv.utterances = newQueue()
+		a.setUp(conv.utterances)
+		go stream.decodeConversation(conv)
+	}
+	return false
+}
+
+// finish notes that one half of a Conversation is complete
+//
+// When both halves are complete, the Conversation is forgotten,
+// so a new conversation between the same endpoints gets a new Conversation.
+func (a *Assembler) finish(stream *Stream) {
+	conv := stream.conv
+	conv.lock.Lock()
+	conv.open--
+	open := conv.open
+	conv.lock.Unlock()
+	if open > 0 {
+		return
+	}
+
+	for _, s := range []*Stream{conv.client, conv.server} {
+		if s == nil {
+			continue
+		}
+		key := flowKey{s.Net, s.Transport}
+		if a.conversations[key] == conv {
+			delete(a.conversations, key)
+		}
+	}
+	if conv.utterances != nil {
+		conv.utterances.close()
+	}
+}
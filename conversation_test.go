@@ -0,0 +1,196 @@
+package netshovel
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// withFlags returns a copy of an Ethernet/IPv4/TCP packet with more TCP flags set
+func withFlags(packet gopacket.Packet, flags byte) gopacket.Packet {
+	data := append([]byte(nil), packet.Data()...)
+	data[14+20+13] |= flags
+	p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	*p.Metadata() = *packet.Metadata()
+	return p
+}
+
+// withACK returns a copy of an Ethernet/IPv4/TCP packet with the ACK flag set
+func withACK(packet gopacket.Packet) gopacket.Packet {
+	return withFlags(packet, 0x10)
+}
+
+// handshake returns a conversation between a client and a server
+func handshake(t *testing.T) PacketSlice {
+	when := time.Unix(1500000000, 0)
+	return PacketSlice{
+		tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 100, true, nil),
+		withACK(tcpPacket(t, when, "10.0.0.2", "10.0.0.1", 80, 1234, 500, true, nil)),
+		withACK(tcpPacket(t, when.Add(1*time.Second), "10.0.0.1", "10.0.0.2", 1234, 80, 101, false, []byte("hello"))),
+		withACK(tcpPacket(t, when.Add(2*time.Second), "10.0.0.2", "10.0.0.1", 80, 1234, 501, false, []byte("hi there"))),
+		withACK(tcpPacket(t, when.Add(3*time.Second), "10.0.0.1", "10.0.0.2", 1234, 80, 106, false, []byte("bye"))),
+	}
+}
+
+func TestConversationPairing(t *testing.T) {
+	factory := &testStreamFactory{streams: make(chan *Stream, 10)}
+	assembler := NewAssembler(factory)
+	source := handshake(t)
+	if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(factory.streams) != 2 {
+		t.Fatalf("Got %d streams", len(factory.streams))
+	}
+	client, server := <-factory.streams, <-factory.streams
+	conv := client.Conversation()
+	if conv == nil || server.Conversation() != conv {
+		t.Fatal("Streams weren't paired")
+	}
+	if !conv.Handshake {
+		t.Error("Missed the handshake")
+	}
+	if conv.Client() != client || conv.Server() != server || conv.Other(server) != client {
+		t.Error("Client and server mixed up")
+	}
+	if client.Role() != ClientRole || server.Role() != ServerRole {
+		t.Errorf("Wrong roles: %v %v", client.Role(), server.Role())
+	}
+	pkt := NewPacket()
+	if d := server.Describe(pkt); !strings.HasPrefix(d, "10.0.0.1:1234 ← 10.0.0.2:80\n") {
+		t.Errorf("Wrong description: %q", d)
+	}
+
+	assembler.FlushAll()
+	for _, s := range []*Stream{client, server} {
+		u, err := s.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (s == client) != (u.Direction == FromClient) {
+			t.Errorf("Wrong direction %v for %q", u.Direction, u.Data.String(""))
+		}
+	}
+	if _, err := conv.Read(); err != ErrNotMerged {
+		t.Errorf("Read on an unmerged conversation: %v", err)
+	}
+}
+
+func TestConversationFactory(t *testing.T) {
+	type said struct {
+		Direction
+		text string
+	}
+	heard := make(chan said, 10)
+	factory := &ConversationFactory{
+		Decode: func(conv *Conversation) {
+			for {
+				u, err := conv.Read()
+				if err == io.EOF {
+					close(heard)
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				heard <- said{u.Direction, u.Data.String("")}
+			}
+		},
+	}
+
+	assembler := NewAssembler(factory)
+	source := handshake(t)
+	if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+		t.Fatal(err)
+	}
+	assembler.FlushAll()
+	assembler.Wait()
+
+	expected := []said{
+		{FromClient, "hello"},
+		{FromServer, "hi there"},
+		{FromClient, "bye"},
+	}
+	for _, e := range expected {
+		if s := <-heard; s != e {
+			t.Errorf("Expected %v, got %v", e, s)
+		}
+	}
+	if s, more := <-heard; more {
+		t.Errorf("Heard too much: %v", s)
+	}
+}
+
+func TestConversationDoneEarly(t *testing.T) {
+	gaveUp := make(chan struct{})
+	factory := &ConversationFactory{
+		Decode: func(conv *Conversation) {
+			if _, err := conv.Read(); err != nil {
+				t.Error(err)
+			}
+			conv.Done()
+			close(gaveUp)
+		},
+	}
+
+	assembler := NewAssembler(factory)
+	when := time.Unix(1500000000, 0)
+	client := PacketSlice{
+		tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 100, true, nil),
+		withACK(tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 101, false, []byte("hello"))),
+	}
+	if err := ShovelSource(context.Background(), &client, assembler); err != nil {
+		t.Fatal(err)
+	}
+	<-gaveUp
+
+	// The server only turns up after the decoder is Done,
+	// and says more than the queue holds
+	server := PacketSlice{
+		withACK(tcpPacket(t, when, "10.0.0.2", "10.0.0.1", 80, 1234, 500, true, nil)),
+	}
+	for i := 0; i < 300; i++ {
+		server = append(server, withACK(tcpPacket(t, when, "10.0.0.2", "10.0.0.1", 80, 1234, uint32(501+4*i), false, []byte("data"))))
+	}
+	finished := make(chan error)
+	go func() {
+		err := ShovelSource(context.Background(), &server, assembler)
+		assembler.FlushAll()
+		assembler.Wait()
+		finished <- err
+	}()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Assembler is stuck on a half nobody is reading")
+	}
+}
+
+func TestGuessRole(t *testing.T) {
+	expected := []struct {
+		sport, dport int
+		role         Role
+	}{
+		{80, 40000, ServerRole},
+		{40000, 80, ClientRole},
+		{8080, 50000, ServerRole},
+		{50000, 8080, ClientRole},
+		{2000, 3000, ServerRole},
+		{5000, 5000, UnknownRole},
+	}
+	for _, e := range expected {
+		transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{byte(e.sport >> 8), byte(e.sport)}, []byte{byte(e.dport >> 8), byte(e.dport)})
+		if role := guessRole(transport); role != e.role {
+			t.Errorf("%d→%d: expected %v, got %v", e.sport, e.dport, e.role, role)
+		}
+	}
+}
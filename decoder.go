@@ -0,0 +1,140 @@
+package netshovel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// A Decoder decodes Streams
+//
+// Decode is run in its own goroutine for each Stream,
+// and should Read until it gets io.EOF, or return early if ctx is canceled.
+// Returning io.EOF is the same as returning nil.
+type Decoder interface {
+	Decode(ctx context.Context, stream *Stream) error
+}
+
+// DecoderFunc lets an ordinary function be a Decoder
+type DecoderFunc func(ctx context.Context, stream *Stream) error
+
+// Decode calls f(ctx, stream)
+func (f DecoderFunc) Decode(ctx context.Context, stream *Stream) error {
+	return f(ctx, stream)
+}
+
+// A StreamError is something that went wrong decoding a Stream
+type StreamError struct {
+	Net, Transport gopacket.Flow
+	Err            error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("%v:%v → %v:%v: %v",
+		e.Net.Src().String(), e.Transport.Src().String(),
+		e.Net.Dst().String(), e.Transport.Dst().String(),
+		e.Err,
+	)
+}
+
+// Unwrap returns the underlying error
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// A PanicError is recorded when a Decoder panics
+type PanicError struct {
+	Value interface{} // What was passed to panic
+	Stack []byte      // Where it happened
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Decoder panicked: %v", e.Value)
+}
+
+// A DecoderFactory runs a Decoder on every Stream
+//
+// Pass one of these to Shovel instead of your own StreamFactory,
+// and netshovel looks after the goroutines for you.
+// It makes Streams for UDP flows too.
+//
+// Errors returned by the Decoder are collected, along with which Stream they came from.
+// If the Decoder panics, the panic is collected as a PanicError,
+// and the rest of that Stream is thrown away,
+// so one malformed Stream can't stop everything else being decoded.
+type DecoderFactory struct {
+	ctx     context.Context
+	decoder Decoder
+
+	running sync.WaitGroup
+	lock    sync.Mutex
+	errors  []*StreamError
+}
+
+// NewDecoderFactory returns a DecoderFactory which runs decoder on every Stream
+//
+// Each Decode is passed ctx.
+func NewDecoderFactory(ctx context.Context, decoder Decoder) *DecoderFactory {
+	return &DecoderFactory{
+		ctx:     ctx,
+		decoder: decoder,
+	}
+}
+
+// New makes a Stream for one half of a TCP conversation, and starts decoding it
+func (f *DecoderFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	return f.start(net, transport)
+}
+
+// NewUDP makes a Stream for one half of a UDP conversation, and starts decoding it
+func (f *DecoderFactory) NewUDP(net, transport gopacket.Flow) UDPStream {
+	return f.start(net, transport)
+}
+
+func (f *DecoderFactory) start(net, transport gopacket.Flow) *Stream {
+	stream := NewStream(net, transport)
+	f.running.Add(1)
+	go f.decode(stream)
+	return stream
+}
+
+// decode runs the Decoder on stream, collecting anything that goes wrong
+func (f *DecoderFactory) decode(stream *Stream) {
+	defer f.running.Done()
+	defer stream.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			f.fail(stream, &PanicError{Value: r, Stack: debug.Stack()})
+		}
+	}()
+
+	if err := f.decoder.Decode(f.ctx, stream); err != nil && err != io.EOF {
+		f.fail(stream, err)
+	}
+}
+
+// fail records an error decoding stream
+func (f *DecoderFactory) fail(stream *Stream, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.errors = append(f.errors, &StreamError{stream.Net, stream.Transport, err})
+}
+
+// Wait waits for every Decoder to finish,
+// and returns what went wrong since the last time Wait was called.
+//
+// Decoders only finish once their Stream does,
+// so flush the Assembler first.
+func (f *DecoderFactory) Wait() []*StreamError {
+	f.running.Wait()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	errs := f.errors
+	f.errors = nil
+	return errs
+}
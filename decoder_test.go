@@ -0,0 +1,47 @@
+package netshovel
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDecoderFactory(t *testing.T) {
+	errServer := errors.New("server said something weird")
+	decoder := DecoderFunc(func(ctx context.Context, stream *Stream) error {
+		u, err := stream.Read(-1)
+		if err != nil {
+			return err
+		}
+		if stream.Role() == ClientRole {
+			panic("client said " + u.Data.String(""))
+		}
+		// Leave the rest unread: the factory has to finish up for us
+		return errServer
+	})
+
+	factory := NewDecoderFactory(context.Background(), decoder)
+	source := handshake(t)
+	report, err := ShovelWithOptions(context.Background(), factory, Options{Sources: []PacketSource{&source}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Decoders) != 2 {
+		t.Fatalf("Expected 2 decoder errors, got %v", report.Decoders)
+	}
+	var panicked, failed bool
+	for _, e := range report.Decoders {
+		var pe *PanicError
+		if errors.As(e, &pe) {
+			panicked = pe.Value == "client said hello" && len(pe.Stack) > 0
+		}
+		failed = failed || errors.Is(e, errServer)
+	}
+	if !panicked || !failed {
+		t.Errorf("Wrong decoder errors: %v", report.Decoders)
+	}
+	if errs := factory.Wait(); errs != nil {
+		t.Errorf("Errors reported twice: %v", errs)
+	}
+}
@@ -0,0 +1,286 @@
+package netshovel
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FragmentStats counts what a Defragmenter has done
+type FragmentStats struct {
+	Fragments   int // Fragments seen
+	Reassembled int // Datagrams put back together
+
+	// Datagrams which never completed
+	Timeouts   int // Given up on after waiting Timeout for more fragments
+	Evictions  int // Thrown away to stay under MaxFragments
+	Unfinished int // Still waiting for fragments at the end of the capture
+
+	Lost    int // Fragments of datagrams which never completed
+	Invalid int // Fragments which couldn't be part of any datagram
+}
+
+// A Defragmenter puts fragmented IPv4 and IPv6 packets back together
+//
+// Use NewDefragmenter to make one.
+type Defragmenter struct {
+	// Timeout is how long to wait for the rest of a datagram,
+	// after its first fragment shows up
+	Timeout time.Duration
+
+	// MaxFragments is the most fragments held at once.
+	// When there are more, the oldest datagrams are thrown away.
+	MaxFragments int
+
+	Stats FragmentStats
+
+	held    int // How many fragments are held right now
+	pending map[fragKey]*fragDatagram
+	order   []*fragDatagram // Pending datagrams, oldest first
+}
+
+// NewDefragmenter returns a new Defragmenter, with the same limits as Linux
+func NewDefragmenter() *Defragmenter {
+	return &Defragmenter{
+		Timeout:      30 * time.Second,
+		MaxFragments: 8192,
+		pending:      make(map[fragKey]*fragDatagram),
+	}
+}
+
+// fragKey identifies the datagram a fragment belongs to
+type fragKey struct {
+	net   gopacket.Flow
+	id    uint32
+	proto layers.IPProtocol
+}
+
+// A fragment is one piece of a datagram
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+// A fragDatagram is a datagram still missing some fragments
+type fragDatagram struct {
+	key       fragKey
+	first     time.Time // When the first fragment showed up
+	header    []byte    // Network header of the first fragment (offset 0)
+	length    int       // Total length of the payload, once the last fragment shows up
+	fragments []fragment
+	done      bool // No longer pending
+}
+
+// maxDatagram is the largest payload an IP datagram can carry
+const maxDatagram = 65535
+
+// Defragment puts fragmented IP packets in ls back together
+//
+// It returns the layers of the reassembled packet,
+// with everything up to the fragmented network layer taken from ls,
+// and everything after it decoded from the reassembled datagram.
+// Unfragmented packets are returned as they are.
+// If more fragments are needed, this returns nil.
+func (d *Defragmenter) Defragment(ls []gopacket.Layer, when time.Time) []gopacket.Layer {
+	for i := 0; i < len(ls); i++ {
+		start := i // Where the fragmented network layer is
+		var key fragKey
+		var frag fragment
+		var more bool
+		var header []byte
+		var decoder gopacket.LayerType
+
+		switch l := ls[i].(type) {
+		case *layers.IPv4:
+			if l.Flags&layers.IPv4MoreFragments == 0 && l.FragOffset == 0 {
+				continue
+			}
+			key = fragKey{l.NetworkFlow(), uint32(l.Id), l.Protocol}
+			frag = fragment{int(l.FragOffset) * 8, l.Payload}
+			more = l.Flags&layers.IPv4MoreFragments != 0
+			header = l.Contents
+			decoder = layers.LayerTypeIPv4
+		case *layers.IPv6Fragment:
+			start = previousIPv6(ls[:i])
+			if start < 0 {
+				continue
+			}
+			ip := ls[start].(*layers.IPv6)
+			key = fragKey{ip.NetworkFlow(), l.Identification, l.NextHeader}
+			frag = fragment{int(l.FragmentOffset) * 8, l.Payload}
+			more = l.MoreFragments
+			header = ip.Contents
+			decoder = layers.LayerTypeIPv6
+		default:
+			continue
+		}
+
+		payload := d.add(key, frag, more, header, when)
+		if payload == nil {
+			return nil
+		}
+		datagram := rebuildHeader(decoder, header, key.proto, len(payload))
+		datagram = append(datagram, payload...)
+		inner := gopacket.NewPacket(datagram, decoder, gopacket.Default)
+
+		// Keep everything before the fragmented network layer
+		ls = append(ls[:start:start], inner.Layers()...)
+		i = start
+	}
+	return ls
+}
+
+// previousIPv6 returns the index of the last IPv6 layer in ls, or -1
+func previousIPv6(ls []gopacket.Layer) int {
+	for i := len(ls) - 1; i >= 0; i-- {
+		if _, ok := ls[i].(*layers.IPv6); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// add adds a fragment, returning the whole payload if this completes its datagram
+func (d *Defragmenter) add(key fragKey, frag fragment, more bool, header []byte, when time.Time) []byte {
+	d.Stats.Fragments++
+	d.expire(when)
+
+	end := frag.offset + len(frag.data)
+	if end > maxDatagram || (more && len(frag.data)%8 != 0) {
+		d.Stats.Invalid++
+		return nil
+	}
+
+	dg := d.pending[key]
+	if dg == nil {
+		dg = &fragDatagram{key: key, first: when, length: -1}
+		d.pending[key] = dg
+		d.order = append(d.order, dg)
+	}
+	if frag.offset == 0 {
+		dg.header = append([]byte(nil), header...)
+	}
+	if !more {
+		if dg.length >= 0 && dg.length != end {
+			// Two different last fragments: nothing sensible can come of this
+			d.Stats.Invalid++
+			d.drop(dg)
+			return nil
+		}
+		dg.length = end
+	}
+	// The packet's buffer may get reused, so keep our own copy
+	frag.data = append([]byte(nil), frag.data...)
+	dg.fragments = append(dg.fragments, frag)
+	d.held++
+
+	if payload := dg.reassemble(); payload != nil {
+		d.Stats.Reassembled++
+		d.remove(dg)
+		return payload
+	}
+
+	for d.MaxFragments > 0 && d.held > d.MaxFragments {
+		d.trim()
+		d.Stats.Evictions++
+		d.drop(d.order[0])
+	}
+	return nil
+}
+
+// reassemble returns the payload if every fragment is present, otherwise nil
+func (dg *fragDatagram) reassemble() []byte {
+	if dg.length < 0 || dg.header == nil {
+		return nil
+	}
+	sort.SliceStable(dg.fragments, func(i, j int) bool {
+		return dg.fragments[i].offset < dg.fragments[j].offset
+	})
+
+	// Where fragments overlap, the one starting earliest wins
+	payload := make([]byte, 0, dg.length)
+	for _, f := range dg.fragments {
+		if f.offset > len(payload) {
+			return nil
+		}
+		if end := f.offset + len(f.data); end > len(payload) {
+			payload = append(payload, f.data[len(payload)-f.offset:]...)
+		}
+	}
+	if len(payload) < dg.length {
+		return nil
+	}
+	return payload[:dg.length]
+}
+
+// expire gives up on datagrams which have been waiting longer than Timeout
+func (d *Defragmenter) expire(now time.Time) {
+	if d.Timeout <= 0 {
+		return
+	}
+	for d.trim(); len(d.order) > 0 && now.Sub(d.order[0].first) > d.Timeout; d.trim() {
+		d.Stats.Timeouts++
+		d.drop(d.order[0])
+	}
+}
+
+// Flush gives up on every datagram still waiting for fragments
+func (d *Defragmenter) Flush() {
+	for _, dg := range d.order {
+		if !dg.done {
+			d.Stats.Unfinished++
+			d.drop(dg)
+		}
+	}
+	d.order = nil
+}
+
+// drop throws away an incomplete datagram
+func (d *Defragmenter) drop(dg *fragDatagram) {
+	d.Stats.Lost += len(dg.fragments)
+	d.remove(dg)
+}
+
+// remove forgets about a datagram
+func (d *Defragmenter) remove(dg *fragDatagram) {
+	d.held -= len(dg.fragments)
+	dg.done = true
+	delete(d.pending, dg.key)
+}
+
+// trim removes finished datagrams from the front of d.order
+func (d *Defragmenter) trim() {
+	for len(d.order) > 0 && d.order[0].done {
+		d.order[0] = nil
+		d.order = d.order[1:]
+	}
+}
+
+// rebuildHeader returns a copy of a fragment's network header,
+// altered to describe an unfragmented datagram carrying length bytes of proto
+func rebuildHeader(decoder gopacket.LayerType, header []byte, proto layers.IPProtocol, length int) []byte {
+	if decoder == layers.LayerTypeIPv6 {
+		h := append([]byte(nil), header[:40]...)
+		binary.BigEndian.PutUint16(h[4:6], uint16(length))
+		h[6] = byte(proto)
+		return h
+	}
+
+	h := append([]byte(nil), header...)
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(h)+length))
+	h[6] &^= 0x3f // More fragments, and the top of the fragment offset
+	h[7] = 0
+	h[10], h[11] = 0, 0
+	var sum uint32
+	for i := 0; i+1 < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(h[10:12], ^uint16(sum))
+	return h
+}
@@ -0,0 +1,140 @@
+package netshovel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fragment4 splits an Ethernet/IPv4 packet into fragments carrying size bytes each
+func fragment4(packet gopacket.Packet, id uint16, size int) []gopacket.Packet {
+	data := packet.Data()
+	eth, hdr, payload := data[:14], data[14:34], data[34:]
+	var frags []gopacket.Packet
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		h := append([]byte(nil), hdr...)
+		binary.BigEndian.PutUint16(h[2:4], uint16(len(h)+end-off))
+		binary.BigEndian.PutUint16(h[4:6], id)
+		flags := uint16(off / 8)
+		if end < len(payload) {
+			flags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(h[6:8], flags)
+		frag := append(append(append([]byte(nil), eth...), h...), payload[off:end]...)
+		frags = append(frags, gopacket.NewPacket(frag, layers.LayerTypeEthernet, gopacket.Default))
+	}
+	return frags
+}
+
+// fragment6 splits an IPv6 packet into Ethernet frames with fragments carrying size bytes each
+func fragment6(data []byte, id uint32, size int) []gopacket.Packet {
+	eth := []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1, 0x86, 0xdd}
+	hdr, payload := data[:40], data[40:]
+	var frags []gopacket.Packet
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		h := append([]byte(nil), hdr...)
+		binary.BigEndian.PutUint16(h[4:6], uint16(8+end-off))
+		h[6] = byte(layers.IPProtocolIPv6Fragment)
+		fh := make([]byte, 8)
+		fh[0] = hdr[6]
+		offmore := uint16(off/8) << 3
+		if end < len(payload) {
+			offmore |= 1
+		}
+		binary.BigEndian.PutUint16(fh[2:4], offmore)
+		binary.BigEndian.PutUint32(fh[4:8], id)
+		frag := append(append(append(append([]byte(nil), eth...), h...), fh...), payload[off:end]...)
+		frags = append(frags, gopacket.NewPacket(frag, layers.LayerTypeEthernet, gopacket.Default))
+	}
+	return frags
+}
+
+func TestDefragment(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	text := []byte(strings.Repeat("All work and no play makes Jack a dull boy. ", 4))
+
+	v4 := fragment4(tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 100, false, text), 7, 48)
+	v6 := fragment6(tcp6Packet(t, 1234, text), 7, 64)
+	// This one never finishes
+	lost := fragment4(tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 5678, 80, 100, false, text), 8, 48)[1:]
+
+	// Mix them all up
+	var source PacketSlice
+	source = append(source, v4[2], v6[1], v4[0], lost[0], v6[0], v4[1])
+	source = append(source, v4[3:]...)
+	source = append(source, v6[2:]...)
+	source = append(source, lost[1:]...)
+	for _, p := range source {
+		p.Metadata().Timestamp = when
+	}
+
+	factory := &testStreamFactory{streams: make(chan *Stream, 10)}
+	assembler := NewAssembler(factory)
+	if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+		t.Fatal(err)
+	}
+	assembler.FlushAll()
+
+	if len(factory.streams) != 2 {
+		t.Fatalf("Got %d streams", len(factory.streams))
+	}
+	for i := 0; i < 2; i++ {
+		stream := <-factory.streams
+		u, err := stream.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(u.Data.Bytes(), text) {
+			t.Errorf("%v: wrong data %q", stream.Net, u.Data.String(""))
+		}
+	}
+
+	stats := assembler.Defragmenter.Stats
+	if stats.Reassembled != 2 {
+		t.Errorf("Reassembled %d datagrams", stats.Reassembled)
+	}
+	if stats.Unfinished != 1 || stats.Lost != len(lost) {
+		t.Errorf("Wrong stats for unfinished datagram: %+v", stats)
+	}
+}
+
+func TestDefragmentLimits(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	text := []byte(strings.Repeat("x", 100))
+	packet := tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 100, false, text)
+
+	d := NewDefragmenter()
+	d.MaxFragments = 4
+	for id := uint16(0); id < 3; id++ {
+		for _, p := range fragment4(packet, id, 48)[:2] {
+			if d.Defragment(p.Layers(), when) != nil {
+				t.Error("Incomplete datagram reassembled")
+			}
+		}
+	}
+	if d.Stats.Evictions != 1 || d.Stats.Lost != 2 {
+		t.Errorf("Wrong stats after eviction: %+v", d.Stats)
+	}
+
+	last := fragment4(packet, 2, 48)[2]
+	if d.Defragment(last.Layers(), when.Add(time.Minute)) != nil {
+		t.Error("Timed-out datagram reassembled")
+	}
+	if d.Stats.Timeouts != 2 || d.Stats.Lost != 6 {
+		t.Errorf("Wrong stats after timeout: %+v", d.Stats)
+	}
+}
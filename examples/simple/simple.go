@@ -1,24 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"log"
 	"strings"
-	"sync"
 
 	"github.com/dirtbags/netshovel"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/tcpassembly"
 )
 
-var wg sync.WaitGroup
-
-type SimpleStreamFactory struct {
-}
-
-type SimpleStream struct {
-	*netshovel.Stream
+// SimpleDecoder dumps every utterance in every stream
+type SimpleDecoder struct {
 }
 
 type SimplePacket struct {
@@ -31,17 +22,7 @@ func NewSimplePacket() SimplePacket {
 	}
 }
 
-func (f *SimpleStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
-	stream := &SimpleStream{
-		Stream: netshovel.NewStream(net, transport),
-	}
-	wg.Add(1)
-	go stream.Decode(&wg)
-
-	return stream
-}
-
-func (stream SimpleStream) Display(pkt SimplePacket) {
+func Display(stream *netshovel.Stream, pkt SimplePacket) {
 	out := new(strings.Builder)
 
 	fmt.Fprintf(out, "Simple %v:%v → %v:%v\n",
@@ -52,26 +33,23 @@ func (stream SimpleStream) Display(pkt SimplePacket) {
 	fmt.Println(out.String())
 }
 
-func (stream SimpleStream) Decode(wg *sync.WaitGroup) {
-	for {
+func (d SimpleDecoder) Decode(ctx context.Context, stream *netshovel.Stream) error {
+	for ctx.Err() == nil {
 		pkt := NewSimplePacket()
 
 		utterance, err := stream.Read(-1)
 		if err != nil {
-			if err != io.EOF {
-				log.Println(err)
-			}
-			break
+			return err
 		}
 
 		pkt.Payload = utterance.Data
 		pkt.When = utterance.When
-		stream.Display(pkt)
+		Display(stream, pkt)
 	}
-	wg.Done()
+	return ctx.Err()
 }
 
 func main() {
-	netshovel.Shovel(&SimpleStreamFactory{})
-	wg.Wait()
+	ctx := context.Background()
+	netshovel.Shovel(ctx, netshovel.NewDecoderFactory(ctx, SimpleDecoder{}))
 }
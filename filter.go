@@ -0,0 +1,73 @@
+package netshovel
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// windowSource passes along only packets captured within a time window
+type windowSource struct {
+	PacketSource
+	start, end time.Time
+}
+
+// WindowSource returns a PacketSource with only the packets from source captured between start and end
+//
+// A zero start or end leaves that side of the window open.
+// Packets outside the window are dropped before they get anywhere near the assembler,
+// which saves a lot of time on large captures.
+func WindowSource(source PacketSource, start, end time.Time) PacketSource {
+	if start.IsZero() && end.IsZero() {
+		return source
+	}
+	return &windowSource{source, start, end}
+}
+
+func (s *windowSource) NextPacket() (gopacket.Packet, error) {
+	for {
+		packet, err := s.PacketSource.NextPacket()
+		if err != nil {
+			return nil, err
+		}
+		when := packet.Metadata().Timestamp
+		if !s.start.IsZero() && when.Before(s.start) {
+			continue
+		}
+		if !s.end.IsZero() && when.After(s.end) {
+			continue
+		}
+		return packet, nil
+	}
+}
+
+func (s *windowSource) Live() bool {
+	return isLive(s.PacketSource)
+}
+
+// linkTypeOf guesses the link type a packet was decoded with
+func linkTypeOf(packet gopacket.Packet) layers.LinkType {
+	if note := noteOf(packet.Metadata().CaptureInfo); note != nil {
+		return note.LinkType
+	}
+	pls := packet.Layers()
+	if len(pls) == 0 {
+		return layers.LinkTypeEthernet
+	}
+	switch pls[0].LayerType() {
+	case layers.LayerTypeLinuxSLL:
+		return layers.LinkTypeLinuxSLL
+	case layers.LayerTypeLoopback:
+		return layers.LinkTypeNull
+	case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		return layers.LinkTypeRaw
+	case layers.LayerTypeDot11:
+		return layers.LinkTypeIEEE802_11
+	case layers.LayerTypeRadioTap:
+		return layers.LinkTypeIEEE80211Radio
+	case layers.LayerTypePPP:
+		return layers.LinkTypePPP
+	}
+	return layers.LinkTypeEthernet
+}
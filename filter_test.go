@@ -0,0 +1,33 @@
+package netshovel
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestWindowSource(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	source := PacketSlice{}
+	for i := 0; i < 10; i++ {
+		when := start.Add(time.Duration(i) * time.Second)
+		source = append(source, tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, uint32(i), false, nil))
+	}
+
+	window := WindowSource(&source, start.Add(2*time.Second), start.Add(5*time.Second))
+	var got []uint32
+	for {
+		packet, err := window.NextPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, packet.TransportLayer().(*layers.TCP).Seq)
+	}
+	if len(got) != 4 || got[0] != 2 || got[3] != 5 {
+		t.Errorf("Wrong packets in window: %v", got)
+	}
+}
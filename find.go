@@ -0,0 +1,153 @@
+package netshovel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Magic numbers at the start of capture files
+var captureMagics = []uint32{
+	0xa1b2c3d4, // pcap, microseconds
+	0xd4c3b2a1,
+	0xa1b23c4d, // pcap, nanoseconds
+	0x4d3cb2a1,
+	pcapngMagic,
+}
+
+// IsCapture returns true if the file at path looks like a capture file, possibly compressed
+//
+// This goes by what's in the file, not the file name.
+func IsCapture(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return false
+	}
+	m := binary.BigEndian.Uint32(magic[:])
+	for _, cm := range captureMagics {
+		if m == cm {
+			return true
+		}
+	}
+	return false
+}
+
+// FindCaptures expands a list of command-line arguments into capture files
+//
+// Glob patterns are expanded,
+// and directories are searched recursively for capture files,
+// which are recognized by their contents rather than their names.
+// Files named outright are always included.
+//
+// The files found are sorted by the timestamp of their first packet,
+// so they can be shoveled one after another as though they were one big capture.
+// Standard input ("-") and interfaces ("iface:eth0") are left alone,
+// ahead of the files.
+//
+// Anything that can't be searched, like an unreadable directory,
+// or a glob pattern matching nothing, is skipped.
+// Everything else is still returned,
+// along with a CaptureError for the first thing skipped.
+func FindCaptures(args ...string) ([]string, error) {
+	var first error
+	found := findCaptures(args, func(name string, err error) {
+		if first == nil {
+			first = &CaptureError{name, err}
+		}
+	})
+	return found, first
+}
+
+// findCaptures does the work of FindCaptures,
+// calling skip with everything that can't be searched
+func findCaptures(args []string, skip func(name string, err error)) []string {
+	var special, files []string
+
+	for _, arg := range args {
+		if arg == "-" || strings.HasPrefix(arg, ifacePrefix) {
+			special = append(special, arg)
+			continue
+		}
+
+		matches := []string{arg}
+		glob := strings.ContainsAny(arg, "*?[")
+		if glob {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				skip(arg, err)
+				continue
+			}
+			if len(matches) == 0 {
+				skip(arg, errors.New("No files match"))
+				continue
+			}
+		}
+
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil || !fi.IsDir() {
+				// Let whoever opens it report any problems with files named outright
+				if !glob || IsCapture(match) {
+					files = append(files, match)
+				}
+				continue
+			}
+			filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					// Carry on with everything else
+					skip(path, err)
+					return nil
+				}
+				if info.Mode().IsRegular() && IsCapture(path) {
+					files = append(files, path)
+				}
+				return nil
+			})
+		}
+	}
+
+	firsts := make(map[string]time.Time, len(files))
+	for _, fn := range files {
+		firsts[fn] = firstTimestamp(fn)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return firsts[files[i]].Before(firsts[files[j]])
+	})
+
+	return append(special, files...)
+}
+
+// firstTimestamp returns the timestamp of the first packet in a capture file
+//
+// Files which can't be read return the zero time.
+func firstTimestamp(filename string) time.Time {
+	source, err := OpenFile(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	defer source.Close()
+
+	packet, err := source.NextPacket()
+	if err != nil {
+		return time.Time{}
+	}
+	return packet.Metadata().Timestamp
+}
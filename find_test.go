@@ -0,0 +1,123 @@
+package netshovel
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writeCapture writes a one-packet capture, captured at when
+func writeCapture(t *testing.T, path string, when time.Time, compress bool) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if compress {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+
+	pw := pcapgo.NewWriter(w)
+	pw.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	packet := tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 1, false, nil)
+	if err := pw.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindCaptures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netshovel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1500000000, 0)
+	writeCapture(t, filepath.Join(dir, "b", "late.cap"), start.Add(2*time.Hour), false)
+	writeCapture(t, filepath.Join(dir, "a", "middle"), start.Add(time.Hour), true)
+	writeCapture(t, filepath.Join(dir, "c", "d", "early.pcap"), start, false)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "notes.pcap"), []byte("not a capture"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := FindCaptures("iface:eth0", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"iface:eth0",
+		filepath.Join(dir, "c", "d", "early.pcap"),
+		filepath.Join(dir, "a", "middle"),
+		filepath.Join(dir, "b", "late.cap"),
+	}
+	if len(found) != len(expected) {
+		t.Fatalf("Found %v", found)
+	}
+	for i := range expected {
+		if found[i] != expected[i] {
+			t.Errorf("Found %v, wanted %v", found, expected)
+			break
+		}
+	}
+
+	found, err = FindCaptures(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Errorf("Glob found %v", found)
+	}
+}
+
+func TestFindCapturesSkips(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netshovel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1500000000, 0)
+	writeCapture(t, filepath.Join(dir, "a", "one.pcap"), start, false)
+	writeCapture(t, filepath.Join(dir, "b", "two.pcap"), start.Add(time.Hour), false)
+
+	found, err := FindCaptures(filepath.Join(dir, "*.nothing"), dir)
+	var ce *CaptureError
+	if !errors.As(err, &ce) || ce.Name != filepath.Join(dir, "*.nothing") {
+		t.Errorf("Wrong error for glob matching nothing: %v", err)
+	}
+	if len(found) != 2 {
+		t.Errorf("Found %v", found)
+	}
+
+	// An unreadable directory doesn't stop the rest from being found
+	unreadable := filepath.Join(dir, "a")
+	if err := os.Chmod(unreadable, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(unreadable, 0755)
+	if _, err := ioutil.ReadDir(unreadable); err == nil {
+		t.Skip("Can't make an unreadable directory (running as root?)")
+	}
+	found, err = FindCaptures(dir)
+	if !errors.As(err, &ce) || ce.Name != unreadable {
+		t.Errorf("Wrong error for unreadable directory: %v", err)
+	}
+	if len(found) != 1 || found[0] != filepath.Join(dir, "b", "two.pcap") {
+		t.Errorf("Found %v", found)
+	}
+}
@@ -0,0 +1,138 @@
+package netshovel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrBadLength is returned by a Framer when a length field makes no sense
+var ErrBadLength = errors.New("Bad message length")
+
+// A Framer splits a Stream into messages, using a length field in each message's header
+//
+// The header runs from the start of the message to the end of the length field.
+// For instance, a protocol with a 2-byte magic number,
+// followed by a 4-byte big-endian length of the whole message,
+// would use
+//
+//	Framer{Stream: stream, LengthOffset: 2, LengthSize: 4, Order: binary.BigEndian, IncludesHeader: true}
+type Framer struct {
+	Stream *Stream
+
+	LengthOffset int              // How many bytes come before the length field
+	LengthSize   int              // How many bytes long the length field is: 1, 2, 3, 4, or 8
+	Order        binary.ByteOrder // Byte order of the length field, big-endian if nil
+	Adjustment   int              // Added to the length field, for protocols which are off by some amount
+
+	// IncludesHeader is true if the length counts the header too,
+	// and false if it only counts what follows the length field.
+	IncludesHeader bool
+
+	// If nonzero, messages longer than this return ErrBadLength,
+	// so a decoder that's lost its framing can't make you buffer forever.
+	MaxLength int
+}
+
+// Next reads the next whole message
+//
+// The header is peeled off,
+// and recorded as header fields:
+// whatever comes before the length field is called "header",
+// and the length field is called "length".
+// Payload is everything after the length field.
+//
+// At the end of the stream, this returns io.EOF.
+// If the stream ends partway through a message,
+// this returns what it got, with io.ErrUnexpectedEOF,
+// and the Stream is marked Done.
+func (f *Framer) Next() (Packet, error) {
+	pkt := NewPacket()
+	switch f.LengthSize {
+	case 1, 2, 3, 4, 8:
+	default:
+		return pkt, fmt.Errorf("Weird length field size: %d", f.LengthSize)
+	}
+	headerLen := f.LengthOffset + f.LengthSize
+
+	header, err := f.Stream.Read(headerLen)
+	if err != nil {
+		return pkt, err
+	}
+	pkt.When = header.When
+	pkt.Payload = header.Data
+	if header.Data.Length() < headerLen {
+		f.Stream.Done()
+		return pkt, io.ErrUnexpectedEOF
+	}
+
+	if f.LengthOffset > 0 {
+		b, err := pkt.Peel(f.LengthOffset)
+		if err != nil {
+			return pkt, err
+		}
+		pkt.AddHeaderField(f.order(), "header", f.LengthOffset*8, b)
+	}
+	length, err := f.readLength(&pkt)
+	if err != nil {
+		return pkt, err
+	}
+
+	bodyLen := length + f.Adjustment
+	if f.IncludesHeader {
+		bodyLen -= headerLen
+	}
+	if bodyLen < 0 || (f.MaxLength > 0 && headerLen+bodyLen > f.MaxLength) {
+		return pkt, fmt.Errorf("%w: %d", ErrBadLength, length)
+	}
+	if bodyLen == 0 {
+		return pkt, nil
+	}
+
+	body, err := f.Stream.Read(bodyLen)
+	if err == io.EOF {
+		return pkt, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return pkt, err
+	}
+	pkt.When = body.When
+	pkt.Payload = body.Data
+	if body.Data.Length() < bodyLen {
+		f.Stream.Done()
+		return pkt, io.ErrUnexpectedEOF
+	}
+	return pkt, nil
+}
+
+// order returns the byte order of the length field
+func (f *Framer) order() binary.ByteOrder {
+	if f.Order == nil {
+		return binary.BigEndian
+	}
+	return f.Order
+}
+
+// readLength peels the length field off pkt
+func (f *Framer) readLength(pkt *Packet) (int, error) {
+	value, err := pkt.readUint(f.order(), f.LengthSize*8, "length")
+	if err != nil {
+		return 0, err
+	}
+
+	var length uint64
+	switch v := value.(type) {
+	case uint8:
+		length = uint64(v)
+	case uint16:
+		length = uint64(v)
+	case uint32:
+		length = uint64(v)
+	case uint64:
+		length = v
+	}
+	if length > uint64(int(^uint(0)>>1)) {
+		return 0, fmt.Errorf("%w: %d", ErrBadLength, length)
+	}
+	return int(length), nil
+}
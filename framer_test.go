@@ -0,0 +1,74 @@
+package netshovel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/dirtbags/netshovel/gapstring"
+)
+
+func TestFramer(t *testing.T) {
+	stream := testStream(
+		gapstring.OfBytes([]byte{'H', 'K', 0, 0, 0, 10, 7, 0, 'h', 'i', 'H', 'K'}),
+		gapstring.OfBytes([]byte{0, 0, 0, 9, 7, 0, 'a', 'H', 'K', 0xff, 0, 0, 0}),
+		gapstring.OfBytes([]byte{'H', 'K', 0, 0, 0, 50, 7}),
+	)
+	framer := Framer{
+		Stream:         stream,
+		LengthOffset:   2,
+		LengthSize:     4,
+		Order:          binary.BigEndian,
+		IncludesHeader: true,
+		MaxLength:      100,
+	}
+
+	for _, body := range []string{"\x07\x00hi", "\x07\x00a"} {
+		pkt, err := framer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := pkt.Payload.String(""); s != body {
+			t.Errorf("Expected %q, got %q", body, s)
+		}
+		if h := pkt.DescribeHeader(); !strings.Contains(h, "header") || !strings.Contains(h, "length") {
+			t.Errorf("Header fields not recorded:\n%s", h)
+		}
+	}
+
+	if _, err := framer.Next(); !errors.Is(err, ErrBadLength) {
+		t.Errorf("Expected ErrBadLength, got %v", err)
+	}
+	if pkt, err := framer.Next(); err != io.ErrUnexpectedEOF || pkt.Payload.String("") != "\x07" {
+		t.Errorf("Expected a short message, got %q %v", pkt.Payload.String(""), err)
+	}
+	if !closed(stream.done) {
+		t.Error("Stream not Done after a short message")
+	}
+	if _, err := framer.Next(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+// wrappedOrder is a little-endian ByteOrder that isn't binary.LittleEndian
+type wrappedOrder struct {
+	binary.ByteOrder
+}
+
+func TestFramerLittleEndian(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, wrappedOrder{binary.LittleEndian}} {
+		stream := testStream(gapstring.OfBytes([]byte{3, 0, 0, 'a', 'b', 'c', 1, 0, 0, 'd'}))
+		framer := Framer{Stream: stream, LengthSize: 3, Order: order}
+		for _, body := range []string{"abc", "d"} {
+			pkt, err := framer.Next()
+			if err != nil {
+				t.Fatalf("%T: %v", order, err)
+			}
+			if s := pkt.Payload.String(""); s != body {
+				t.Errorf("%T: expected %q, got %q", order, body, s)
+			}
+		}
+	}
+}
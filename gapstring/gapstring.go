@@ -16,6 +16,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"regexp"
 	"strings"
 	"unicode/utf16"
 )
@@ -224,6 +225,50 @@ func (g GapString) ValueAt(pos int) int {
 	}
 }
 
+// Return the position of the first instance of sep, or -1 if it isn't there
+//
+// Gaps never match anything, so sep must lie entirely within data.
+func (g GapString) Index(sep []byte) int {
+	return g.indexFunc(func(run []byte) int {
+		return bytes.Index(run, sep)
+	})
+}
+
+// Return the position of the leftmost match of re, or -1 if there isn't one
+//
+// Like Index, matches never span a gap.
+func (g GapString) IndexRegexp(re *regexp.Regexp) int {
+	return g.indexFunc(func(run []byte) int {
+		if loc := re.FindIndex(run); loc != nil {
+			return loc[0]
+		}
+		return -1
+	})
+}
+
+// Return the position of the first match of find in any run of data between gaps
+func (g GapString) indexFunc(find func(run []byte) int) int {
+	pos := 0
+	for i := 0; i < len(g.chunks); {
+		if g.chunks[i].gap > 0 {
+			pos += g.chunks[i].gap
+			i += 1
+			continue
+		}
+
+		// Join up neighbouring chunks of data, so matches can straddle them
+		run := g.chunks[i].data
+		for i += 1; i < len(g.chunks) && g.chunks[i].gap == 0; i += 1 {
+			run = append(run[:len(run):len(run)], g.chunks[i].data...)
+		}
+		if n := find(run); n >= 0 {
+			return pos + n
+		}
+		pos += len(run)
+	}
+	return -1
+}
+
 // Return a string version of the GapString, with gaps filled in
 func (g GapString) String(fill string) string {
 	return string(g.Bytes([]byte(fill)...))
@@ -2,6 +2,7 @@ package gapstring
 
 import (
 	"bytes"
+	"regexp"
 	"testing"
 )
 
@@ -68,6 +69,12 @@ func TestGapString(t *testing.T) {
 	assertEqual(t, "slice", g.Slice(2, 5).String(""), "oba")
 	assertEqual(t, "slice+xor", g.Slice(2, 5).Xor(1).String(""), "nc`")
 
+	assertEqual(t, "index", g.Index([]byte("oba")), 2)
+	assertEqual(t, "index after gap", g.Index([]byte("baz")), 14)
+	assertEqual(t, "index across gap", g.Index([]byte("rb")), -1)
+	assertEqual(t, "index missing", g.Index([]byte("cow")), -1)
+	assertEqual(t, "index regexp", g.IndexRegexp(regexp.MustCompile("b.z")), 14)
+
 	hexdump :=
 		"00000000  6d 6f 6f 62 61 72 -- --  -- -- -- -- -- -- 62 61  moobar��������ba\n" +
 			"00000010  7a                                                z\n" +
@@ -2,4 +2,8 @@ module github.com/dirtbags/netshovel
 
 go 1.13
 
-require github.com/google/gopacket v1.1.18
+require (
+	github.com/google/gopacket v1.1.18
+	github.com/klauspost/compress v1.12.3
+	github.com/ulikunitz/xz v0.5.11
+)
@@ -4,40 +4,25 @@
 package netshovel
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"strings"
-	"sync"
 	"testing"
-
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/tcpassembly"
 )
 
-var wg sync.WaitGroup
+// HKDecoder decodes HKStreams.
+type HKDecoder struct{}
 
-// HKStreamFactory generates HKStreams.
-type HKStreamFactory struct {
-	err *error
-}
-
-// New returns a new HKStream.
-func (f *HKStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
-	stream := &HKStream{
-		Stream: NewStream(net, transport),
-		err:    f.err,
-	}
-	wg.Add(1)
-	go stream.Decode(&wg)
-
-	return stream
+// Decode decodes one half of a TCP Stream as HK.
+func (d HKDecoder) Decode(ctx context.Context, stream *Stream) error {
+	return HKStream{stream}.Decode()
 }
 
 // HKStream represents half of a TCP Stream.
 type HKStream struct {
 	*Stream
-	err *error
 }
 
 func (stream HKStream) Read(length int) (Utterance, error) {
@@ -67,44 +52,44 @@ func (stream HKStream) Display(pkt HKPacket) {
 }
 
 // Decode decodes all data from the stream.
-func (stream HKStream) Decode(wg *sync.WaitGroup) {
-	defer wg.Done()
+func (stream HKStream) Decode() error {
 	for {
-		utterance, err := stream.Read(2)
+		magic, err := stream.Peek(2)
 		if err == io.EOF {
-			return
+			return nil
 		} else if err != nil {
 			log.Println(err)
-			return
+			return nil
 		}
 
 		// Was it actually HK?
-		if utterance.Data.String("DROP") != "HK" {
-			u, err := stream.Read(-1)
+		if magic.Data.String("DROP") != "HK" {
+			utterance, err := stream.Read(-1)
 			if err != nil {
 				log.Println(err)
-				return
-			}
-
-			if utterance.When != u.When {
-				stream.DisplayUtterance(utterance)
-				utterance = u
-				*stream.err = fmt.Errorf("Short length on non-HK packet, and a different utterance was returned")
-			} else {
-				utterance.Data = utterance.Data.Append(u.Data)
+				return nil
 			}
 			if utterance.Data.Length() < 10 {
-				*stream.err = fmt.Errorf("Short length on non-HK packet")
-				return
+				return fmt.Errorf("Short length on non-HK packet")
 			}
 			stream.DisplayUtterance(utterance)
 			continue
 		}
 
+		utterance, _ := stream.Read(2)
 		pkt := NewHKPacket(utterance)
 		if err := pkt.Decode(stream); err != nil {
 			log.Println(err)
-			return
+
+			// Skip to the next packet, instead of giving up on the stream
+			skipped, err := stream.SeekPattern([]byte("HK"), 0)
+			if skipped.Data.Length() > 0 {
+				stream.DisplayUtterance(skipped)
+			}
+			if err != nil {
+				return nil
+			}
+			continue
 		}
 		stream.Display(pkt)
 	}
@@ -166,14 +151,14 @@ func (pkt *HKPacket) Decode(stream HKStream) error {
 }
 
 func TestHK(t *testing.T) {
-	factory := HKStreamFactory{err: new(error)}
-	streamPool := tcpassembly.NewStreamPool(&factory)
-	assembler := tcpassembly.NewAssembler(streamPool)
-	ShovelFile("testdata/hk.pcap", assembler)
+	factory := NewDecoderFactory(context.Background(), HKDecoder{})
+	assembler := NewAssembler(factory)
+	if err := ShovelFile(context.Background(), "testdata/hk.pcap", assembler); err != nil {
+		t.Fatal(err)
+	}
 	assembler.FlushAll()
-	wg.Wait()
 
-	if *factory.err != nil {
-		t.Error(*factory.err)
+	for _, err := range factory.Wait() {
+		t.Error(err)
 	}
 }
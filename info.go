@@ -0,0 +1,145 @@
+package netshovel
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// A CloseReason says why a Stream ended
+type CloseReason int
+
+// CloseReasons
+const (
+	StillOpen          CloseReason = iota // The Stream hasn't ended yet
+	ClosedFIN                             // The sender said it was finished
+	ClosedRST                             // The connection was reset
+	ClosedIdle                            // Nothing was seen for too long
+	ClosedEndOfCapture                    // The capture ended, or Shovel was interrupted
+	ClosedOther                           // Something else ended the Stream
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case StillOpen:
+		return "open"
+	case ClosedFIN:
+		return "FIN"
+	case ClosedRST:
+		return "RST"
+	case ClosedIdle:
+		return "idle"
+	case ClosedEndOfCapture:
+		return "end of capture"
+	}
+	return "other"
+}
+
+// StreamInfo describes what the Assembler has seen of a Stream
+//
+// This is counted as packets are assembled,
+// which is usually ahead of what your decoder has read.
+type StreamInfo struct {
+	FirstSeen, LastSeen time.Time // When the first and last packets were captured
+
+	Bytes    int // Bytes of data seen
+	Segments int // TCP segments or UDP datagrams with data in them
+	Missing  int // Bytes lost in gaps
+
+	// TCP segments starting before the furthest point already seen.
+	// These are nearly always retransmissions,
+	// though segments which arrive out of order are counted too.
+	Retransmissions int
+
+	// Why the Stream ended.
+	// This is StillOpen until the Assembler has finished with it.
+	Closed CloseReason
+}
+
+// Info returns what the Assembler has seen of this Stream so far
+//
+// Once Read returns io.EOF, this is final,
+// and Closed says why the Stream ended,
+// so you can tell a truncated session from a finished one.
+func (stream *Stream) Info() StreamInfo {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	return stream.info
+}
+
+// seen notes that data was captured at when
+func (stream *Stream) seen(when time.Time) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if stream.info.FirstSeen.IsZero() || when.Before(stream.info.FirstSeen) {
+		stream.info.FirstSeen = when
+	}
+	if when.After(stream.info.LastSeen) {
+		stream.info.LastSeen = when
+	}
+}
+
+// observe notes things about a TCP segment that reassembly hides
+func (stream *Stream) observe(tcp *layers.TCP) {
+	stream.sawFIN = stream.sawFIN || tcp.FIN
+	stream.sawRST = stream.sawRST || tcp.RST
+	if len(tcp.Payload) == 0 {
+		return
+	}
+
+	end := tcp.Seq + uint32(len(tcp.Payload))
+	if stream.seqSeen && int32(tcp.Seq-stream.seqEnd) < 0 {
+		stream.lock.Lock()
+		stream.info.Retransmissions++
+		stream.lock.Unlock()
+	}
+	if !stream.seqSeen || int32(end-stream.seqEnd) > 0 {
+		stream.seqEnd = end
+		stream.seqSeen = true
+	}
+}
+
+// closeReason works out why the Assembler is closing this Stream
+func (stream *Stream) closeReason() CloseReason {
+	a := stream.assembler
+	if a == nil {
+		return ClosedOther
+	}
+
+	// Was it the packet being assembled right now?
+	if tcp, ok := a.transport.(*layers.TCP); ok && tcp.TransportFlow() == stream.Transport {
+		switch {
+		case tcp.RST:
+			return ClosedRST
+		case tcp.FIN:
+			return ClosedFIN
+		}
+	}
+	// Or one that was waiting for a gap to be filled?
+	if stream.ended {
+		switch {
+		case stream.sawRST:
+			return ClosedRST
+		case stream.sawFIN:
+			return ClosedFIN
+		}
+	}
+	if a.closing != StillOpen {
+		return a.closing
+	}
+	return ClosedOther
+}
+
+// streamOf returns the Stream for one direction of a flow, if there is one
+func (a *Assembler) streamOf(key flowKey) *Stream {
+	conv := a.conversations[key]
+	if conv == nil {
+		return nil
+	}
+	for _, s := range []*Stream{conv.client, conv.server} {
+		if s != nil && s.Net == key.net && s.Transport == key.transport {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package netshovel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStreamInfo(t *testing.T) {
+	const fin = 0x01
+	when := time.Unix(1500000000, 0)
+	source := handshake(t)
+	source = append(source,
+		withACK(tcpPacket(t, when.Add(4*time.Second), "10.0.0.1", "10.0.0.2", 1234, 80, 101, false, []byte("hello"))),
+		withFlags(withACK(tcpPacket(t, when.Add(5*time.Second), "10.0.0.1", "10.0.0.2", 1234, 80, 109, false, nil)), fin),
+	)
+
+	factory := &testStreamFactory{streams: make(chan *Stream, 10), drain: true}
+	assembler := NewAssembler(factory)
+	if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+		t.Fatal(err)
+	}
+	client := <-factory.streams
+	if info := client.Info(); info.Closed != ClosedFIN {
+		t.Errorf("Client should have closed with FIN: %v", info.Closed)
+	}
+
+	assembler.FlushAll()
+	assembler.Wait()
+	server := <-factory.streams
+
+	info := client.Info()
+	expected := StreamInfo{
+		FirstSeen:       when,
+		LastSeen:        when.Add(5 * time.Second),
+		Bytes:           8,
+		Segments:        2,
+		Retransmissions: 1,
+		Closed:          ClosedFIN,
+	}
+	if info != expected {
+		t.Errorf("Wrong client info:\n%+v\nexpected\n%+v", info, expected)
+	}
+	if info := server.Info(); info.Closed != ClosedEndOfCapture || info.Bytes != 8 || info.Segments != 1 {
+		t.Errorf("Wrong server info: %+v", info)
+	}
+}
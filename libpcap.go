@@ -0,0 +1,105 @@
+//go:build cgo
+// +build cgo
+
+package netshovel
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// handleCloser adapts a pcap Handle to io.Closer
+type handleCloser struct {
+	*pcap.Handle
+}
+
+func (h handleCloser) Close() error {
+	h.Handle.Close()
+	return nil
+}
+
+func newHandleSource(handle *pcap.Handle, live bool) *CaptureSource {
+	return &CaptureSource{
+		reader:   handle,
+		linkType: handle.LinkType(),
+		closer:   handleCloser{handle},
+		live:     live,
+	}
+}
+
+// OpenLibpcapFile opens a capture file for reading with libpcap
+//
+// This can read anything your libpcap can,
+// but requires cgo.
+func OpenLibpcapFile(filename string) (*CaptureSource, error) {
+	handle, err := pcap.OpenOffline(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newHandleSource(handle, false), nil
+}
+
+// OpenInterface begins a live capture on a network interface
+func OpenInterface(iface string) (*CaptureSource, error) {
+	handle, err := pcap.OpenLive(iface, Snaplen, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	return newHandleSource(handle, true), nil
+}
+
+// bpfSource passes along only packets matching a BPF expression
+type bpfSource struct {
+	PacketSource
+	expr    string
+	filters map[layers.LinkType]*pcap.BPF
+}
+
+// FilterSource returns a PacketSource with only the packets from source matching a BPF expression
+//
+// Live captures and files opened with OpenLibpcapFile are filtered by libpcap itself.
+// Anything else is checked one packet at a time.
+func FilterSource(source PacketSource, expr string) (PacketSource, error) {
+	if cs, ok := source.(*CaptureSource); ok {
+		if handle, ok := cs.reader.(*pcap.Handle); ok {
+			return source, handle.SetBPFFilter(expr)
+		}
+	}
+
+	// Compile it once now, so a bad expression is reported right away
+	if _, err := pcap.NewBPF(layers.LinkTypeEthernet, int(Snaplen), expr); err != nil {
+		return nil, err
+	}
+	return &bpfSource{
+		PacketSource: source,
+		expr:         expr,
+		filters:      make(map[layers.LinkType]*pcap.BPF),
+	}, nil
+}
+
+func (s *bpfSource) NextPacket() (gopacket.Packet, error) {
+	for {
+		packet, err := s.PacketSource.NextPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		linkType := linkTypeOf(packet)
+		filter, ok := s.filters[linkType]
+		if !ok {
+			filter, err = pcap.NewBPF(linkType, int(Snaplen), s.expr)
+			if err != nil {
+				return nil, err
+			}
+			s.filters[linkType] = filter
+		}
+		if filter.Matches(packet.Metadata().CaptureInfo, packet.Data()) {
+			return packet, nil
+		}
+	}
+}
+
+func (s *bpfSource) Live() bool {
+	return isLive(s.PacketSource)
+}
@@ -0,0 +1,171 @@
+package netshovel
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DuplicateWindow is how far apart two identical packets can be,
+// and still be considered the same packet seen by two sensors.
+var DuplicateWindow = 50 * time.Millisecond
+
+// A packet at the head of one of the merged sources
+type mergeHead struct {
+	packet gopacket.Packet
+	source PacketSource
+}
+
+// mergeHeap orders source heads by timestamp
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	return h[i].packet.Metadata().Timestamp.Before(h[j].packet.Metadata().Timestamp)
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// A packet we've recently sent along, for spotting duplicates
+type seenPacket struct {
+	when time.Time
+	sum  uint64
+}
+
+// mergeSource interleaves packets from several sources
+type mergeSource struct {
+	pending []PacketSource // Sources we haven't read from yet
+	heads   mergeHeap
+	recent  []seenPacket // In timestamp order
+	counts  map[uint64]int
+	live    bool // Some source is live
+}
+
+// MergeSources returns a PacketSource which interleaves packets from all sources in timestamp order
+//
+// This is meant for capture files:
+// each source must itself be in timestamp order,
+// which is true of pretty much every capture file.
+// Packets that are identical from the network layer up,
+// and arrive within DuplicateWindow of one another,
+// are assumed to have been seen by overlapping sensors:
+// only the first one is passed along.
+//
+// If any source is live, so is the merge,
+// and idle streams are flushed as usual.
+// But nothing can be passed along until every source has a packet waiting,
+// so a quiet network interface holds up everything else being merged.
+func MergeSources(sources ...PacketSource) PacketSource {
+	m := &mergeSource{
+		pending: sources,
+		counts:  make(map[uint64]int),
+	}
+	for _, source := range sources {
+		m.live = m.live || isLive(source)
+	}
+	return m
+}
+
+// pull reads the next packet from source into the heap
+func (m *mergeSource) pull(source PacketSource) error {
+	packet, err := source.NextPacket()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	heap.Push(&m.heads, mergeHead{packet, source})
+	return nil
+}
+
+func (m *mergeSource) NextPacket() (gopacket.Packet, error) {
+	for len(m.pending) > 0 {
+		source := m.pending[0]
+		m.pending = m.pending[1:]
+		if err := m.pull(source); err != nil {
+			return nil, err
+		}
+	}
+
+	for m.heads.Len() > 0 {
+		head := heap.Pop(&m.heads).(mergeHead)
+		if err := m.pull(head.source); err != nil {
+			return nil, err
+		}
+		if !m.duplicate(head.packet) {
+			return head.packet, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// Live returns true if any source being merged is live
+func (m *mergeSource) Live() bool {
+	return m.live
+}
+
+// duplicate returns true if an identical packet was recently sent along
+func (m *mergeSource) duplicate(packet gopacket.Packet) bool {
+	when := packet.Metadata().Timestamp
+
+	// Forget about anything too old to matter
+	expired := 0
+	for _, s := range m.recent {
+		if when.Sub(s.when) <= DuplicateWindow {
+			break
+		}
+		m.counts[s.sum]--
+		if m.counts[s.sum] == 0 {
+			delete(m.counts, s.sum)
+		}
+		expired++
+	}
+	m.recent = m.recent[expired:]
+
+	sum := packetSum(packet)
+	if m.counts[sum] > 0 {
+		return true
+	}
+	m.counts[sum]++
+	m.recent = append(m.recent, seenPacket{when, sum})
+	return false
+}
+
+// packetSum hashes a packet from the network layer up
+//
+// Fields that change as a packet crosses a router (TTL, hop limit, checksum)
+// are left out, so sensors on either side of a router agree.
+func packetSum(packet gopacket.Packet) uint64 {
+	h := fnv.New64a()
+	nl := packet.NetworkLayer()
+	if nl == nil {
+		h.Write(packet.Data())
+		return h.Sum64()
+	}
+
+	hdr := append([]byte{}, nl.LayerContents()...)
+	switch nl.LayerType() {
+	case layers.LayerTypeIPv4:
+		if len(hdr) >= 12 {
+			hdr[8] = 0
+			hdr[10], hdr[11] = 0, 0
+		}
+	case layers.LayerTypeIPv6:
+		if len(hdr) >= 8 {
+			hdr[7] = 0
+		}
+	}
+	h.Write(hdr)
+	h.Write(nl.LayerPayload())
+	return h.Sum64()
+}
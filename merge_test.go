@@ -0,0 +1,63 @@
+package netshovel
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestMergeSources(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	a := PacketSlice{
+		tcpPacket(t, at(0), "10.0.0.1", "10.0.0.2", 1234, 80, 0, false, nil),
+		tcpPacket(t, at(200), "10.0.0.1", "10.0.0.2", 1234, 80, 2, false, nil),
+		tcpPacket(t, at(400), "10.0.0.1", "10.0.0.2", 1234, 80, 4, false, nil),
+	}
+	b := PacketSlice{
+		tcpPacket(t, at(100), "10.0.0.1", "10.0.0.2", 1234, 80, 1, false, nil),
+		// The same packet as a[1], seen by another sensor with a slightly different clock
+		tcpPacket(t, at(201), "10.0.0.1", "10.0.0.2", 1234, 80, 2, false, nil),
+		tcpPacket(t, at(300), "10.0.0.1", "10.0.0.2", 1234, 80, 3, false, nil),
+	}
+
+	merged := MergeSources(&a, &b)
+	var got []uint32
+	for {
+		packet, err := merged.NextPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, packet.TransportLayer().(*layers.TCP).Seq)
+	}
+	if len(got) != 5 {
+		t.Fatalf("Wrong number of packets: %v", got)
+	}
+	for i, seq := range got {
+		if seq != uint32(i) {
+			t.Errorf("Out of order: %v", got)
+			break
+		}
+	}
+}
+
+func TestMergeLive(t *testing.T) {
+	var files PacketSlice
+	if isLive(MergeSources(&files)) {
+		t.Error("Merged files are live")
+	}
+
+	packets := make(chan gopacket.Packet)
+	close(packets)
+	if !isLive(MergeSources(&files, liveChannel{packets})) {
+		t.Error("Merge with a live source isn't live")
+	}
+}
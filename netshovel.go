@@ -9,52 +9,441 @@ It can be used as a template for new work.
 package netshovel
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 )
 
+// FlushInterval is how often idle streams are flushed during live capture
+var FlushInterval = 10 * time.Second
+
+// IdleTimeout is how long a live stream may go without traffic before it is flushed.
+//
+// Flushed streams receive ReassemblyComplete,
+// so your decoder sees the end of idle connections
+// without having to wait for the capture to stop.
+var IdleTimeout = 2 * time.Minute
+
+// Snaplen is the number of bytes captured from each packet during live capture
+var Snaplen int32 = 65536
+
+// ifacePrefix marks a command-line argument as a network interface, instead of a file
+const ifacePrefix = "iface:"
+
+// timeFlag is a command-line flag holding an RFC3339 time
+type timeFlag struct {
+	time.Time
+}
+
+func (f *timeFlag) String() string {
+	if f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339Nano)
+}
+
+func (f *timeFlag) Set(value string) error {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	f.Time = t
+	return err
+}
+
 // Shovel handles dispatching of PCAP files from the command line.
 // It's intended that you invoke this from your main function.
 // This parses the command line arguments,
 // and for each PCAP file specified on the command line,
 // invokes a TCP assembler that sends streams to whatever is returned from factory.
-func Shovel(factory tcpassembly.StreamFactory) {
+// If factory is also a UDPStreamFactory, it gets UDP flows too.
+// The easiest way to get a factory is NewDecoderFactory.
+//
+// Capture files may be compressed with gzip, zstd, xz, or bzip2,
+// and "-" reads a capture from standard input.
+// Arguments of the form "iface:eth0",
+// or an interface provided with the -i flag,
+// are captured live instead of read from a file.
+// Directories are searched for capture files,
+// and everything found is shoveled in order of first packet,
+// as though it were one big capture.
+//
+// The -filter, -start, and -end flags restrict which packets are shoveled.
+// The -merge flag opens every capture at once,
+// and shovels packets from all of them in timestamp order,
+// dropping duplicates seen by more than one sensor.
+// TCP inside tunnels (GRE, VXLAN, and so on) is unwrapped and reassembled,
+// unless the tunnel type is listed in -ignore-tunnels.
+// The -midstream, -max-pages, and -flush-on-gap flags
+// stop TCP streams with a missing handshake or missing data from waiting around.
+//
+// Any sources you pass in are shoveled before anything on the command line.
+// Problems with individual captures are logged,
+// and don't stop the rest from being shoveled.
+//
+// An interrupt (Ctrl-C), or canceling ctx,
+// stops reading packets, flushes every stream,
+// and, if factory is a DecoderFactory, waits for decoders to finish up.
+// A second interrupt quits immediately.
+//
+// This is a thin wrapper around ShovelWithOptions.
+func Shovel(ctx context.Context, factory tcpassembly.StreamFactory, sources ...PacketSource) {
+	var start, end timeFlag
+	var ignoreTunnels Tunnel
 	//verbose := flag.Bool("verbose", false, "Write lots of information out")
+	iface := flag.String("i", "", "Capture live from `interface`")
+	filter := flag.String("filter", "", "Only shovel packets matching BPF `expression`")
+	flag.Var(&start, "start", "Ignore packets before `time` (RFC3339)")
+	flag.Var(&end, "end", "Ignore packets after `time` (RFC3339)")
+	merge := flag.Bool("merge", false, "Merge all captures in timestamp order")
+	flag.Var(&ignoreTunnels, "ignore-tunnels", "Don't unwrap TCP from these `tunnels` (gre,vxlan,gtpu,erspan,ipip,6in4,all)")
+	midstream := flag.Bool("midstream", false, "Start TCP streams without waiting for a handshake")
+	maxPages := flag.Int("max-pages", 0, "Skip missing TCP data once `pages` are waiting on one connection")
+	flushOnGap := flag.Bool("flush-on-gap", false, "Skip missing TCP data right away, instead of waiting for it")
 	flag.Parse()
 
-	streamPool := tcpassembly.NewStreamPool(factory)
-	assembler := tcpassembly.NewAssembler(streamPool)
+	opts := Options{
+		Captures:      flag.Args(),
+		Sources:       sources,
+		Filter:        *filter,
+		Start:         start.Time,
+		End:           end.Time,
+		Merge:         *merge,
+		IgnoreTunnels: ignoreTunnels,
+		Midstream:     *midstream,
+		MaxPages:      *maxPages,
+		FlushOnGap:    *flushOnGap,
+	}
+	if *iface != "" {
+		opts.Captures = append([]string{ifacePrefix + *iface}, opts.Captures...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Println("Interrupted: flushing streams. Interrupt again to quit now.")
+			signal.Stop(interrupt)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, err := ShovelWithOptions(ctx, factory, opts)
+	if err == context.Canceled {
+		log.Println(err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	for _, err := range report.Errors {
+		log.Println(err)
+	}
+	for _, err := range report.Decoders {
+		log.Println(err)
+	}
+	if lost := report.Fragments.Lost; lost > 0 {
+		log.Printf("%d IP fragments were never put back together", lost)
+	}
+}
+
+// Options control what ShovelWithOptions does
+type Options struct {
+	// Capture files, directories, or glob patterns,
+	// "-" for standard input,
+	// or "iface:" followed by a network interface name.
+	Captures []string
+
+	// Sources are shoveled before Captures
+	Sources []PacketSource
+
+	// If set, only packets matching this BPF expression are shoveled
+	Filter string
+
+	// If set, only packets captured between these times are shoveled
+	Start, End time.Time
+
+	// Merge every capture in timestamp order,
+	// instead of shoveling them one after another.
+	// This works with live captures,
+	// but a quiet interface holds up every other capture (see MergeSources).
+	Merge bool
+
+	// TCP inside these kinds of tunnel is ignored,
+	// instead of being unwrapped and reassembled
+	IgnoreTunnels Tunnel
+
+	// Start TCP streams on their first packet,
+	// instead of waiting for a SYN (see Assembler.Midstream)
+	Midstream bool
+
+	// If nonzero, once this many pages of out-of-order data are waiting on a TCP connection,
+	// whatever's missing is skipped over as a gap.
+	// Otherwise, it waits until the stream is flushed.
+	MaxPages int
+
+	// Skip over missing TCP data as soon as a gap shows up,
+	// instead of waiting for it to be retransmitted.
+	// This is the same as a MaxPages of 1.
+	FlushOnGap bool
+
+	// How many Utterances, and how many bytes, each Stream can hold,
+	// and how many bytes every Stream together can hold,
+	// before decoders fall behind.
+	// Zero means DefaultStreamDepth for StreamDepth,
+	// and no limit for the budgets.
+	StreamDepth, StreamBudget, BufferBudget int
+
+	// What happens when a decoder falls behind
+	Backpressure Backpressure
+}
+
+// ShovelWithOptions shovels packets from everything in opts.Captures and opts.Sources,
+// sending TCP streams (and UDP flows, if factory is also a UDPStreamFactory)
+// to whatever is returned from factory.
+//
+// Problems with individual captures,
+// like files that can't be opened or are truncated,
+// or directories that can't be searched,
+// don't stop anything else from being shoveled:
+// they're collected in the returned Report.
+// An error is only returned for problems with opts itself,
+// like a bad filter expression,
+// or if ctx was canceled.
+//
+// When this returns, every stream has been flushed.
+// If factory is a DecoderFactory, every Decoder has returned too,
+// and what went wrong is in Report.Decoders.
+// Goroutines you started yourself aren't waited for.
+func ShovelWithOptions(ctx context.Context, factory tcpassembly.StreamFactory, opts Options) (Report, error) {
+	var report Report
+
+	// Make sure the filter compiles before doing anything else
+	if opts.Filter != "" {
+		if _, err := FilterSource(&PacketSlice{}, opts.Filter); err != nil {
+			return report, err
+		}
+	}
+
+	// Reads abandoned on live sources (see ShovelSource) can still record errors,
+	// so anything touching report.Errors holds this
+	var lock sync.Mutex
+	record := func(name string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		report.add(name, err)
+	}
+
+	names := findCaptures(opts.Captures, record)
 
-	for _, fn := range flag.Args() {
-		ShovelFile(fn, assembler)
+	prepare := func(name string, source PacketSource) PacketSource {
+		report.Captures++
+		if opts.Filter != "" {
+			// This already compiled once, so it won't fail now
+			source, _ = FilterSource(source, opts.Filter)
+		}
+		source = WindowSource(source, opts.Start, opts.End)
+		return newReportingSource(source, name, record)
+	}
+
+	assembler := NewAssembler(factory)
+	assembler.Tunnels &^= opts.IgnoreTunnels
+	assembler.Midstream = opts.Midstream
+	assembler.MaxBufferedPagesPerConnection = opts.MaxPages
+	if opts.FlushOnGap {
+		assembler.MaxBufferedPagesPerConnection = 1
+	}
+	assembler.StreamDepth = opts.StreamDepth
+	assembler.StreamBudget = opts.StreamBudget
+	assembler.BufferBudget = opts.BufferBudget
+	assembler.Backpressure = opts.Backpressure
+	var sources []PacketSource
+	for i, source := range opts.Sources {
+		sources = append(sources, prepare(fmt.Sprintf("source %d", i), source))
+	}
+	if !opts.Merge {
+		for _, source := range sources {
+			ShovelSource(ctx, source, assembler)
+		}
+	}
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+
+		capture, err := openCapture(name)
+		if err != nil {
+			record(name, err)
+			continue
+		}
+		source := prepare(name, capture)
+		stop := closeOnCancel(ctx, capture)
+		if opts.Merge {
+			defer capture.Close()
+			defer stop()
+			sources = append(sources, source)
+		} else {
+			ShovelSource(ctx, source, assembler)
+			stop()
+			capture.Close()
+		}
+	}
+	if opts.Merge {
+		ShovelSource(ctx, MergeSources(sources...), assembler)
 	}
 
 	assembler.FlushAll()
+	report.Fragments = assembler.Defragmenter.Stats
+	if decoders, ok := factory.(*DecoderFactory); ok {
+		report.Decoders = decoders.Wait()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return report, ctx.Err()
+}
+
+// openCapture opens a capture file, or an interface if name is of the form "iface:eth0"
+func openCapture(name string) (*CaptureSource, error) {
+	if strings.HasPrefix(name, ifacePrefix) {
+		return OpenInterface(strings.TrimPrefix(name, ifacePrefix))
+	}
+	return OpenFile(name)
+}
+
+// closeOnCancel closes a live capture as soon as ctx is canceled
+//
+// Closing is the only way to interrupt a read that's waiting for traffic,
+// which could otherwise keep ShovelSource waiting forever on a quiet interface.
+// Call stop once the capture has been shoveled.
+func closeOnCancel(ctx context.Context, capture *CaptureSource) (stop func()) {
+	if !capture.Live() {
+		return func() {}
+	}
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			capture.Close()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
 }
 
 // ShovelFile shovels a single file.
 // You must call assembler.FlushAll() at the end of this!
-func ShovelFile(filename string, assembler *tcpassembly.Assembler) {
-	handle, err := pcap.OpenOffline(filename)
+func ShovelFile(ctx context.Context, filename string, assembler *Assembler) error {
+	source, err := OpenFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer source.Close()
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packets := packetSource.Packets()
-	for packet := range packets {
-		if packet == nil {
-			break
+	return ShovelSource(ctx, source, assembler)
+}
+
+// ShovelInterface shovels live traffic from a network interface.
+//
+// This only returns if the capture stops, or ctx is canceled.
+// You must call assembler.FlushAll() at the end of this!
+func ShovelInterface(ctx context.Context, iface string, assembler *Assembler) error {
+	source, err := OpenInterface(iface)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	defer closeOnCancel(ctx, source)()
+
+	return ShovelSource(ctx, source, assembler)
+}
+
+// ShovelSource shovels every packet from source.
+//
+// Packets that can't be decoded, like those with an unsupported link type,
+// are skipped: the first such problem is returned after everything else has been shoveled.
+// If source is live,
+// streams which have been idle for IdleTimeout are flushed every FlushInterval.
+// If ctx is canceled, this stops reading packets and returns ctx.Err(),
+// once any read already under way has finished,
+// so source can be closed safely.
+// A live source might not have a packet for a long time, though,
+// so a read waiting on one is abandoned instead:
+// it finishes in the background, once a packet shows up or the source is closed.
+// You must call assembler.FlushAll() at the end of this!
+func ShovelSource(ctx context.Context, source PacketSource, assembler *Assembler) error {
+	packets := make(chan gopacket.Packet)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	go readPackets(source, packets, errs, done)
+
+	live := isLive(source)
+	var flush <-chan time.Time
+	if live {
+		ticker := time.NewTicker(FlushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+
+	for {
+		select {
+		case packet, more := <-packets:
+			if !more {
+				return <-errs
+			}
+			assembler.AssemblePacket(packet)
+		case now := <-flush:
+			assembler.FlushOlderThan(now.Add(-IdleTimeout))
+		case <-ctx.Done():
+			close(done)
+			if !live {
+				// packets is closed when readPackets gives up
+				for range packets {
+				}
+			}
+			return ctx.Err()
 		}
-		if packet.NetworkLayer() == nil || packet.TransportLayer() == nil || packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
+	}
+}
+
+// readPackets sends everything from source down packets.
+//
+// When the source runs dry, packets is closed,
+// and the reason (nil for io.EOF) is sent down errs.
+// If any packets were skipped, and nothing worse happened,
+// the reason the first one was skipped is sent instead.
+// Closing done makes this give up.
+func readPackets(source PacketSource, packets chan<- gopacket.Packet, errs chan<- error, done <-chan struct{}) {
+	var skipped error
+	defer close(packets)
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			errs <- skipped
+			return
+		} else if skippable(err) {
+			if skipped == nil {
+				skipped = err
+			}
 			continue
+		} else if err != nil {
+			errs <- err
+			return
+		}
+		select {
+		case packets <- packet:
+		case <-done:
+			return
 		}
-		tcp := packet.TransportLayer().(*layers.TCP)
-		assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
 	}
 }
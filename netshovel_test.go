@@ -0,0 +1,337 @@
+package netshovel
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// tcpPacket builds an Ethernet/IPv4/TCP packet from src:sport to dst:dport
+func tcpPacket(t *testing.T, when time.Time, src, dst string, sport, dport int, seq uint32, syn bool, payload []byte) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP(dst),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(sport),
+		DstPort: layers.TCPPort(dport),
+		Seq:     seq,
+		SYN:     syn,
+		Window:  1024,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = when
+	packet.Metadata().CaptureLength = len(buf.Bytes())
+	packet.Metadata().Length = len(buf.Bytes())
+	return packet
+}
+
+// testStreamFactory makes Streams, and remembers them
+//
+// If drain is set, each Stream is also read to the end,
+// like a real decoder would.
+type testStreamFactory struct {
+	streams chan *Stream
+	drain   bool
+}
+
+func (f *testStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	stream := NewStream(net, transport)
+	f.streams <- stream
+	if f.drain {
+		go drain(stream)
+	}
+	return stream
+}
+
+// drain reads everything from stream
+func drain(stream *Stream) {
+	for {
+		if _, err := stream.Read(-1); err != nil {
+			return
+		}
+	}
+}
+
+// liveChannel is a stand-in for a network interface
+type liveChannel struct {
+	PacketChannel
+}
+
+func (c liveChannel) Live() bool {
+	return true
+}
+
+func TestShovelSource(t *testing.T) {
+	factory := &testStreamFactory{streams: make(chan *Stream, 10)}
+	assembler := NewAssembler(factory)
+
+	now := time.Now()
+	source := PacketSlice{
+		tcpPacket(t, now, "10.0.0.1", "10.0.0.2", 1234, 80, 100, true, nil),
+		tcpPacket(t, now, "10.0.0.1", "10.0.0.2", 1234, 80, 101, false, []byte("hello")),
+		tcpPacket(t, now, "10.0.0.1", "10.0.0.2", 1234, 80, 106, false, []byte(" world")),
+	}
+	if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+		t.Fatal(err)
+	}
+	if len(source) != 0 {
+		t.Error("Source not drained")
+	}
+	assembler.FlushAll()
+
+	stream := <-factory.streams
+	u, err := stream.Read(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Data.String("") != "hello world" {
+		t.Errorf("Wrong data: %q", u.Data.String(""))
+	}
+}
+
+func TestShovelLiveFlushesIdle(t *testing.T) {
+	oldInterval, oldTimeout := FlushInterval, IdleTimeout
+	FlushInterval, IdleTimeout = 10*time.Millisecond, time.Millisecond
+	defer func() { FlushInterval, IdleTimeout = oldInterval, oldTimeout }()
+
+	factory := &testStreamFactory{streams: make(chan *Stream, 10)}
+	assembler := NewAssembler(factory)
+
+	// The packet source stays open: only the idle flush can end this stream
+	ctx, cancel := context.WithCancel(context.Background())
+	packets := make(chan gopacket.Packet)
+	shoveled := make(chan error)
+	go func() {
+		shoveled <- ShovelSource(ctx, liveChannel{packets}, assembler)
+	}()
+	defer func() {
+		// Stop before the flush settings are put back
+		cancel()
+		close(packets)
+		<-shoveled
+	}()
+
+	// Just one packet, so the flush can't land between the SYN and the data
+	packets <- tcpPacket(t, time.Now(), "10.0.0.1", "10.0.0.2", 1234, 80, 101, false, []byte("hello"))
+
+	stream := <-factory.streams
+	done := make(chan Utterance)
+	go func() {
+		u, _ := stream.Read(-1)
+		stream.Read(-1)
+		done <- u
+	}()
+
+	select {
+	case u := <-done:
+		if u.Data.String("") != "hello" {
+			t.Errorf("Wrong data: %q", u.Data.String(""))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle stream was never flushed")
+	}
+}
+
+func TestShovelWithOptionsReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netshovel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raw, err := ioutil.ReadFile("testdata/hk.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.pcap")
+	if err := ioutil.WriteFile(truncated, raw[:len(raw)-10], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A pcapng file with one interface gopacket can't decode
+	when := time.Unix(1500000000, 0)
+	b := new(ngBuilder)
+	b.section()
+	b.iface(276, "sll2")
+	b.iface(int(layers.LinkTypeEthernet), "eth0")
+	b.packet(0, when, []byte("whatever"))
+	b.packet(1, when, tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 1, false, []byte("hi")).Data())
+	b.packet(0, when, []byte("whatever"))
+	mixed := filepath.Join(dir, "mixed.pcapng")
+	if err := ioutil.WriteFile(mixed, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	factory := &testStreamFactory{streams: make(chan *Stream, 100), drain: true}
+	opts := Options{
+		Captures: []string{filepath.Join(dir, "missing.pcap"), truncated, mixed, filepath.Join(dir, "*.nothing"), "testdata/hk.pcap"},
+	}
+	report, err := ShovelWithOptions(context.Background(), factory, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Captures != 3 {
+		t.Errorf("Opened %d captures", report.Captures)
+	}
+	if len(report.Errors) != 4 {
+		t.Fatalf("Wrong errors: %v", report.Errors)
+	}
+	// Captures are shoveled in order of first packet, so look errors up by name
+	errs := make(map[string]error)
+	for _, e := range report.Errors {
+		errs[filepath.Base(e.Name)] = e
+	}
+	if !os.IsNotExist(errors.Unwrap(errs["missing.pcap"])) {
+		t.Errorf("Wrong error for missing file: %v", errs["missing.pcap"])
+	}
+	if !errors.Is(errs["truncated.pcap"], ErrTruncated) {
+		t.Errorf("Wrong error for truncated file: %v", errs["truncated.pcap"])
+	}
+	if errs["*.nothing"] == nil {
+		t.Errorf("No error for glob matching nothing")
+	}
+	var lte *UnsupportedLinkTypeError
+	if !errors.As(errs["mixed.pcapng"], &lte) || lte.LinkType != 276 {
+		t.Errorf("Wrong error for unsupported link type: %v", errs["mixed.pcapng"])
+	}
+	if len(factory.streams) == 0 {
+		t.Error("Nothing was shoveled")
+	}
+}
+
+// busySource notes when NextPacket is running
+type busySource struct {
+	PacketSource
+	lock sync.Mutex
+	busy bool
+}
+
+func (s *busySource) NextPacket() (gopacket.Packet, error) {
+	s.lock.Lock()
+	s.busy = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.busy = false
+		s.lock.Unlock()
+	}()
+	return s.PacketSource.NextPacket()
+}
+
+func (s *busySource) reading() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.busy
+}
+
+func TestShovelCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	packets := make(chan gopacket.Packet)
+	finished := make(chan bool, 10)
+	factory := NewDecoderFactory(ctx, DecoderFunc(func(ctx context.Context, stream *Stream) error {
+		drain(stream)
+		finished <- true
+		return nil
+	}))
+
+	// A source that never ends, like a network interface
+	now := time.Now()
+	syn := tcpPacket(t, now, "10.0.0.1", "10.0.0.2", 1234, 80, 100, true, nil)
+	data := tcpPacket(t, now, "10.0.0.1", "10.0.0.2", 1234, 80, 101, false, []byte("hello"))
+	go func() {
+		packets <- syn
+		packets <- data
+		cancel()
+		close(packets)
+	}()
+
+	source := &busySource{PacketSource: PacketChannel(packets)}
+	opts := Options{Sources: []PacketSource{source}}
+	if _, err := ShovelWithOptions(ctx, factory, opts); err != context.Canceled {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if source.reading() {
+		t.Error("Returned while still reading packets")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("Returned before decoder finished")
+	}
+}
+
+func TestShovelDoesntWaitForStreams(t *testing.T) {
+	// A decoder which gives up without calling Done
+	factory := &testStreamFactory{streams: make(chan *Stream, 100)}
+	go func() {
+		for stream := range factory.streams {
+			go stream.Read(-1)
+		}
+	}()
+	defer close(factory.streams)
+
+	returned := make(chan error, 1)
+	go func() {
+		_, err := ShovelWithOptions(context.Background(), factory, Options{Captures: []string{"testdata/hk.pcap"}})
+		returned <- err
+	}()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waited for a Stream nobody was reading")
+	}
+}
+
+func TestShovelLiveCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	assembler := NewAssembler(&testStreamFactory{streams: make(chan *Stream, 10)})
+
+	// A quiet interface: nothing ever shows up
+	packets := make(chan gopacket.Packet)
+	defer close(packets)
+	shoveled := make(chan error, 1)
+	go func() {
+		shoveled <- ShovelSource(ctx, liveChannel{packets}, assembler)
+	}()
+	cancel()
+
+	select {
+	case err := <-shoveled:
+		if err != context.Canceled {
+			t.Errorf("Wrong error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Still waiting for a quiet live source")
+	}
+}
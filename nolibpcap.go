@@ -0,0 +1,19 @@
+//go:build !cgo
+// +build !cgo
+
+package netshovel
+
+// OpenLibpcapFile would open a capture file with libpcap, if netshovel had been built with cgo
+func OpenLibpcapFile(filename string) (*CaptureSource, error) {
+	return nil, ErrNoLibpcap
+}
+
+// OpenInterface would begin a live capture, if netshovel had been built with cgo
+func OpenInterface(iface string) (*CaptureSource, error) {
+	return nil, ErrNoLibpcap
+}
+
+// FilterSource would filter packets with a BPF expression, if netshovel had been built with cgo
+func FilterSource(source PacketSource, expr string) (PacketSource, error) {
+	return nil, ErrNoLibpcap
+}
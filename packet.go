@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -237,10 +238,13 @@ func (pkt *Packet) AddHeaderField(order binary.ByteOrder, name string, bits int,
 }
 
 // Peel from Payload an unsigned integer of size bits, adding it to the header field list
+//
+// 24-bit integers are returned as uint32.
 func (pkt *Packet) readUint(order binary.ByteOrder, bits int, name string) (interface{}, error) {
 	switch bits {
 	case 8:
 	case 16:
+	case 24:
 	case 32:
 	case 64:
 	default:
@@ -259,6 +263,15 @@ func (pkt *Packet) readUint(order binary.ByteOrder, bits int, name string) (inte
 		value = b[0]
 	case 16:
 		value = order.Uint16(b)
+	case 24:
+		// Pad it out to 32 bits, with the zero at whichever end order says is most significant
+		var buf [4]byte
+		if order.Uint16([]byte{1, 0}) == 1 {
+			copy(buf[:3], b)
+		} else {
+			copy(buf[1:], b)
+		}
+		value = order.Uint32(buf[:])
 	case 32:
 		value = order.Uint32(b)
 	case 64:
@@ -331,3 +344,91 @@ func (pkt *Packet) Uint8(name string) (uint8, error) {
 	}
 	return value.(uint8), err
 }
+
+// Uint24LE peels off a 24-bit unsigned integer, little-endian
+func (pkt *Packet) Uint24LE(name string) (uint32, error) {
+	value, err := pkt.readUint(binary.LittleEndian, 24, name)
+	if err != nil {
+		return 0, err
+	}
+	return value.(uint32), err
+}
+
+// Uint24BE peels off a 24-bit unsigned integer, big-endian
+func (pkt *Packet) Uint24BE(name string) (uint32, error) {
+	value, err := pkt.readUint(binary.BigEndian, 24, name)
+	if err != nil {
+		return 0, err
+	}
+	return value.(uint32), err
+}
+
+// Signed and floating-point values are recorded in the header
+// as the unsigned integer they were sent as,
+// so the header description always shows what was on the wire.
+
+// Int64LE peels off an int64, little-endian
+func (pkt *Packet) Int64LE(name string) (int64, error) {
+	value, err := pkt.Uint64LE(name)
+	return int64(value), err
+}
+
+// Int32LE peels off an int32, little-endian
+func (pkt *Packet) Int32LE(name string) (int32, error) {
+	value, err := pkt.Uint32LE(name)
+	return int32(value), err
+}
+
+// Int16LE peels off an int16, little-endian
+func (pkt *Packet) Int16LE(name string) (int16, error) {
+	value, err := pkt.Uint16LE(name)
+	return int16(value), err
+}
+
+// Int64BE peels off an int64, big-endian
+func (pkt *Packet) Int64BE(name string) (int64, error) {
+	value, err := pkt.Uint64BE(name)
+	return int64(value), err
+}
+
+// Int32BE peels off an int32, big-endian
+func (pkt *Packet) Int32BE(name string) (int32, error) {
+	value, err := pkt.Uint32BE(name)
+	return int32(value), err
+}
+
+// Int16BE peels off an int16, big-endian
+func (pkt *Packet) Int16BE(name string) (int16, error) {
+	value, err := pkt.Uint16BE(name)
+	return int16(value), err
+}
+
+// Int8 peels off an int8
+func (pkt *Packet) Int8(name string) (int8, error) {
+	value, err := pkt.Uint8(name)
+	return int8(value), err
+}
+
+// Float64LE peels off an IEEE 754 float64, little-endian
+func (pkt *Packet) Float64LE(name string) (float64, error) {
+	value, err := pkt.Uint64LE(name)
+	return math.Float64frombits(value), err
+}
+
+// Float32LE peels off an IEEE 754 float32, little-endian
+func (pkt *Packet) Float32LE(name string) (float32, error) {
+	value, err := pkt.Uint32LE(name)
+	return math.Float32frombits(value), err
+}
+
+// Float64BE peels off an IEEE 754 float64, big-endian
+func (pkt *Packet) Float64BE(name string) (float64, error) {
+	value, err := pkt.Uint64BE(name)
+	return math.Float64frombits(value), err
+}
+
+// Float32BE peels off an IEEE 754 float32, big-endian
+func (pkt *Packet) Float32BE(name string) (float32, error) {
+	value, err := pkt.Uint32BE(name)
+	return math.Float32frombits(value), err
+}
@@ -58,3 +58,48 @@ func TestHeaders(t *testing.T) {
 		t.Error(desc)
 	}
 }
+
+func TestSignedAndFloat(t *testing.T) {
+	pkt := NewPacket()
+	pkt.Payload = gapstring.OfBytes([]byte{
+		0xff,
+		0xfe, 0xff,
+		0xff, 0xff, 0xff, 0xfd,
+		0x01, 0x02, 0x03,
+		0x01, 0x02, 0x03,
+		0x3f, 0xc0, 0x00, 0x00,
+		0, 0, 0, 0, 0, 0, 0x04, 0xc0,
+	})
+
+	if v, err := pkt.Int8("int8"); err != nil || v != -1 {
+		t.Error("Int8", v, err)
+	}
+	if v, err := pkt.Int16LE("int16"); err != nil || v != -2 {
+		t.Error("Int16LE", v, err)
+	}
+	if v, err := pkt.Int32BE("int32"); err != nil || v != -3 {
+		t.Error("Int32BE", v, err)
+	}
+	if v, err := pkt.Uint24BE("be24"); err != nil || v != 0x010203 {
+		t.Error("Uint24BE", v, err)
+	}
+	if v, err := pkt.Uint24LE("le24"); err != nil || v != 0x030201 {
+		t.Error("Uint24LE", v, err)
+	}
+	if v, err := pkt.Float32BE("float32"); err != nil || v != 1.5 {
+		t.Error("Float32BE", v, err)
+	}
+	if v, err := pkt.Float64LE("float64"); err != nil || v != -2.5 {
+		t.Error("Float64LE", v, err)
+	}
+	if _, err := pkt.Int16BE("short"); err == nil {
+		t.Error("Peeled past the end")
+	}
+
+	desc := pkt.DescribeHeader()
+	for _, name := range []string{"int8", "be24", "le24", "float32", "0xfffffffd"} {
+		if !strings.Contains(desc, name) {
+			t.Errorf("%s missing from header:\n%s", name, desc)
+		}
+	}
+}
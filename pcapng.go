@@ -0,0 +1,300 @@
+package netshovel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// A CaptureNote is what a capture file had to say about a packet
+//
+// CaptureSources reading pcapng files attach one of these
+// to the AncillaryData of every packet.
+type CaptureNote struct {
+	LinkType  layers.LinkType // Link type of the capturing interface
+	Interface string          // Name of the capturing interface, if recorded
+	Comments  []string        // Comments attached to the packet
+}
+
+// noteOf returns the CaptureNote attached to some capture info, or nil
+func noteOf(ci gopacket.CaptureInfo) *CaptureNote {
+	for _, a := range ci.AncillaryData {
+		if note, ok := a.(*CaptureNote); ok {
+			return note
+		}
+	}
+	return nil
+}
+
+// pcapng block types
+const (
+	ngBlockInterface      = 0x00000001
+	ngBlockPacket         = 0x00000002 // Obsolete, but still found in the wild
+	ngBlockSimplePacket   = 0x00000003
+	ngBlockEnhancedPacket = 0x00000006
+	ngBlockSection        = pcapngMagic
+	ngByteOrderMagic      = 0x1a2b3c4d
+)
+
+// ngMaxBlockLength is the longest pcapng block we'll read
+//
+// This is what libpcap allows.
+// Anything longer is a corrupt length field,
+// and believing it could mean trying to allocate gigabytes.
+const ngMaxBlockLength = 16 * 1024 * 1024
+
+// pcapng option codes
+const (
+	ngOptEnd        = 0
+	ngOptComment    = 1
+	ngOptIfName     = 2
+	ngOptIfTsresol  = 9
+	ngOptIfTsoffset = 14
+)
+
+// An interface described in a pcapng section
+type ngInterface struct {
+	linkType       int // pcapng allows more link types than gopacket does
+	snaplen        uint32
+	name           string
+	unitsPerSecond uint64
+	offset         int64
+}
+
+// timestamp converts a pcapng timestamp into a time.Time
+func (iface ngInterface) timestamp(ts uint64) time.Time {
+	sec := ts / iface.unitsPerSecond
+	frac := ts % iface.unitsPerSecond
+	var nsec int64
+	if 1000000000%iface.unitsPerSecond == 0 {
+		nsec = int64(frac * (1000000000 / iface.unitsPerSecond))
+	} else {
+		nsec = int64(float64(frac) * 1e9 / float64(iface.unitsPerSecond))
+	}
+	return time.Unix(int64(sec)+iface.offset, nsec).UTC()
+}
+
+// ngReader reads pcapng files, one packet at a time
+//
+// Unlike pcapgo.NgReader,
+// this keeps every interface's link type, name, and packet comments,
+// so captures from several kinds of interface decode properly.
+type ngReader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ifaces []ngInterface
+}
+
+func newNgReader(r io.Reader) (*ngReader, error) {
+	ng := &ngReader{r: r}
+	typ, _, err := ng.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if typ != ngBlockSection {
+		return nil, fmt.Errorf("Not a pcapng file: first block has type %#x", typ)
+	}
+	return ng, nil
+}
+
+// readBlock reads an entire block, returning its type and body
+func (ng *ngReader) readBlock() (uint32, []byte, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(ng.r, hdr[:8]); err != nil {
+		return 0, nil, err
+	}
+
+	// Section headers set the byte order for everything up to the next section header
+	if binary.BigEndian.Uint32(hdr[0:4]) == ngBlockSection {
+		if _, err := io.ReadFull(ng.r, hdr[8:12]); err != nil {
+			return 0, nil, unexpected(err)
+		}
+		if binary.BigEndian.Uint32(hdr[8:12]) == ngByteOrderMagic {
+			ng.order = binary.BigEndian
+		} else if binary.LittleEndian.Uint32(hdr[8:12]) == ngByteOrderMagic {
+			ng.order = binary.LittleEndian
+		} else {
+			return 0, nil, fmt.Errorf("Bad pcapng byte-order magic: %x", hdr[8:12])
+		}
+		ng.ifaces = nil
+	} else if ng.order == nil {
+		return 0, nil, fmt.Errorf("pcapng block before section header")
+	}
+
+	typ := ng.order.Uint32(hdr[0:4])
+	length := ng.order.Uint32(hdr[4:8])
+	if length < 12 || length%4 != 0 {
+		return 0, nil, fmt.Errorf("Bad pcapng block length: %d", length)
+	}
+	if length > ngMaxBlockLength {
+		return 0, nil, fmt.Errorf("pcapng block too long: %d bytes", length)
+	}
+
+	// We've read the header, and need to read the body and the trailing length.
+	body := make([]byte, length-8)
+	if typ == ngBlockSection {
+		copy(body, hdr[8:12])
+		if _, err := io.ReadFull(ng.r, body[4:]); err != nil {
+			return 0, nil, unexpected(err)
+		}
+	} else if _, err := io.ReadFull(ng.r, body); err != nil {
+		return 0, nil, unexpected(err)
+	}
+	return typ, body[:len(body)-4], nil
+}
+
+// unexpected turns EOF in the middle of a block into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readOptions calls f on each option in buf
+func (ng *ngReader) readOptions(buf []byte, f func(code uint16, value []byte)) {
+	for len(buf) >= 4 {
+		code := ng.order.Uint16(buf[0:2])
+		length := int(ng.order.Uint16(buf[2:4]))
+		buf = buf[4:]
+		if code == ngOptEnd || length > len(buf) {
+			return
+		}
+		f(code, buf[:length])
+		padded := (length + 3) &^ 3
+		if padded > len(buf) {
+			return
+		}
+		buf = buf[padded:]
+	}
+}
+
+func (ng *ngReader) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("Short pcapng interface description block")
+	}
+	iface := ngInterface{
+		linkType:       int(ng.order.Uint16(body[0:2])),
+		snaplen:        ng.order.Uint32(body[4:8]),
+		unitsPerSecond: 1000000,
+	}
+	ng.readOptions(body[8:], func(code uint16, value []byte) {
+		switch code {
+		case ngOptIfName:
+			iface.name = string(value)
+		case ngOptIfTsresol:
+			if len(value) < 1 {
+				return
+			}
+			exp := uint(value[0] & 0x7f)
+			base := uint64(10)
+			if value[0]&0x80 != 0 {
+				base = 2
+			}
+			iface.unitsPerSecond = 1
+			for i := uint(0); i < exp && iface.unitsPerSecond < 1<<60; i++ {
+				iface.unitsPerSecond *= base
+			}
+		case ngOptIfTsoffset:
+			if len(value) == 8 {
+				iface.offset = int64(ng.order.Uint64(value))
+			}
+		}
+	})
+	ng.ifaces = append(ng.ifaces, iface)
+	return nil
+}
+
+func (ng *ngReader) iface(id int) (ngInterface, error) {
+	if id >= len(ng.ifaces) {
+		return ngInterface{}, fmt.Errorf("pcapng packet from undescribed interface %d", id)
+	}
+	return ng.ifaces[id], nil
+}
+
+// ReadPacketData returns the next packet in the file
+//
+// The packet's CaptureNote is in ci.AncillaryData.
+func (ng *ngReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		typ, body, err := ng.readBlock()
+		if err != nil {
+			return nil, ci, err
+		}
+
+		var iface ngInterface
+		var options []byte
+		switch typ {
+		case ngBlockSection:
+			// readBlock already forgot the previous section's interfaces
+			continue
+		case ngBlockInterface:
+			if err := ng.readInterface(body); err != nil {
+				return nil, ci, err
+			}
+			continue
+		case ngBlockEnhancedPacket, ngBlockPacket:
+			if len(body) < 20 {
+				return nil, ci, fmt.Errorf("Short pcapng packet block")
+			}
+			if typ == ngBlockEnhancedPacket {
+				ci.InterfaceIndex = int(ng.order.Uint32(body[0:4]))
+			} else {
+				ci.InterfaceIndex = int(ng.order.Uint16(body[0:2]))
+			}
+			if iface, err = ng.iface(ci.InterfaceIndex); err != nil {
+				return nil, ci, err
+			}
+			ts := uint64(ng.order.Uint32(body[4:8]))<<32 | uint64(ng.order.Uint32(body[8:12]))
+			ci.Timestamp = iface.timestamp(ts)
+			ci.CaptureLength = int(ng.order.Uint32(body[12:16]))
+			ci.Length = int(ng.order.Uint32(body[16:20]))
+			body = body[20:]
+			if ci.CaptureLength > len(body) {
+				return nil, ci, fmt.Errorf("pcapng packet longer than its block")
+			}
+			data = body[:ci.CaptureLength]
+			if padded := (ci.CaptureLength + 3) &^ 3; padded <= len(body) {
+				options = body[padded:]
+			}
+		case ngBlockSimplePacket:
+			if len(body) < 4 {
+				return nil, ci, fmt.Errorf("Short pcapng simple packet block")
+			}
+			if iface, err = ng.iface(0); err != nil {
+				return nil, ci, err
+			}
+			ci.Length = int(ng.order.Uint32(body[0:4]))
+			ci.CaptureLength = len(body) - 4
+			if ci.CaptureLength > ci.Length {
+				ci.CaptureLength = ci.Length
+			}
+			if iface.snaplen > 0 && ci.CaptureLength > int(iface.snaplen) {
+				ci.CaptureLength = int(iface.snaplen)
+			}
+			data = body[4 : 4+ci.CaptureLength]
+		default:
+			// Name resolution, statistics, and so forth
+			continue
+		}
+
+		if !supportedLinkType(iface.linkType) {
+			return nil, ci, &UnsupportedLinkTypeError{iface.linkType}
+		}
+		note := &CaptureNote{
+			LinkType:  layers.LinkType(iface.linkType),
+			Interface: iface.name,
+		}
+		ng.readOptions(options, func(code uint16, value []byte) {
+			if code == ngOptComment {
+				note.Comments = append(note.Comments, string(value))
+			}
+		})
+		ci.AncillaryData = []interface{}{note}
+		return data, ci, nil
+	}
+}
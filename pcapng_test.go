@@ -0,0 +1,175 @@
+package netshovel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ngBuilder writes little-endian pcapng files
+type ngBuilder struct {
+	bytes.Buffer
+}
+
+func ngOption(code uint16, value []byte) []byte {
+	opt := make([]byte, 4, 4+len(value)+3)
+	binary.LittleEndian.PutUint16(opt[0:2], code)
+	binary.LittleEndian.PutUint16(opt[2:4], uint16(len(value)))
+	opt = append(opt, value...)
+	for len(opt)%4 != 0 {
+		opt = append(opt, 0)
+	}
+	return opt
+}
+
+func (b *ngBuilder) block(typ uint32, body []byte) {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(len(body) + 12)
+	binary.Write(b, binary.LittleEndian, typ)
+	binary.Write(b, binary.LittleEndian, length)
+	b.Write(body)
+	binary.Write(b, binary.LittleEndian, length)
+}
+
+func (b *ngBuilder) section() {
+	body := []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	b.block(ngBlockSection, body)
+}
+
+func (b *ngBuilder) iface(linkType int, name string) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], uint16(linkType))
+	body = append(body, ngOption(ngOptIfName, []byte(name))...)
+	body = append(body, ngOption(ngOptEnd, nil)...)
+	b.block(ngBlockInterface, body)
+}
+
+func (b *ngBuilder) packet(iface int, when time.Time, data []byte, comments ...string) {
+	ts := uint64(when.UnixNano() / 1000)
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(iface))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	body = append(body, data...)
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	for _, c := range comments {
+		body = append(body, ngOption(ngOptComment, []byte(c))...)
+	}
+	if len(comments) > 0 {
+		body = append(body, ngOption(ngOptEnd, nil)...)
+	}
+	b.block(ngBlockEnhancedPacket, body)
+}
+
+func TestPcapngMixedLinkTypes(t *testing.T) {
+	when := time.Unix(1500000000, 123456000)
+	eth := tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 100, false, []byte("ethernet"))
+
+	// Linux "cooked" capture: same IP packet, different link layer
+	sll := []byte{0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0, 0x08, 0x00}
+	sll = append(sll, eth.Data()[14:]...)
+
+	b := new(ngBuilder)
+	b.section()
+	b.iface(int(layers.LinkTypeEthernet), "eth0")
+	b.iface(int(layers.LinkTypeLinuxSLL), "any")
+	b.packet(0, when, eth.Data(), "first", "second")
+	b.packet(1, when.Add(time.Second), sll)
+
+	source, err := OpenReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		iface    string
+		comments int
+		when     time.Time
+	}{
+		{"eth0", 2, when},
+		{"any", 0, when.Add(time.Second)},
+	}
+	for i, e := range expected {
+		packet, err := source.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.TransportLayer() == nil {
+			t.Errorf("packet %d: didn't decode to TCP: %v", i, packet)
+		}
+		if !packet.Metadata().Timestamp.Equal(e.when) {
+			t.Errorf("packet %d: timestamp %v", i, packet.Metadata().Timestamp)
+		}
+		note := noteOf(packet.Metadata().CaptureInfo)
+		if note == nil {
+			t.Fatalf("packet %d: no CaptureNote", i)
+		}
+		if note.Interface != e.iface || len(note.Comments) != e.comments {
+			t.Errorf("packet %d: wrong note %#v", i, note)
+		}
+	}
+	if _, err := source.NextPacket(); err == nil {
+		t.Error("Read past end of file")
+	}
+}
+
+func TestUtteranceComments(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	b := new(ngBuilder)
+	b.section()
+	b.iface(int(layers.LinkTypeEthernet), "eth0")
+	b.packet(0, when, tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 100, true, nil).Data())
+	b.packet(0, when, tcpPacket(t, when, "10.0.0.1", "10.0.0.2", 1234, 80, 101, false, []byte("hi")).Data(), "look here")
+
+	source, err := OpenReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := &testStreamFactory{streams: make(chan *Stream, 10)}
+	assembler := NewAssembler(factory)
+	if err := ShovelSource(context.Background(), source, assembler); err != nil {
+		t.Fatal(err)
+	}
+	assembler.FlushAll()
+
+	stream := <-factory.streams
+	u, err := stream.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Interface != "eth0" {
+		t.Errorf("Wrong interface %q", u.Interface)
+	}
+	if len(u.Comments) != 1 || u.Comments[0] != "look here" {
+		t.Errorf("Wrong comments %#v", u.Comments)
+	}
+}
+
+func TestPcapngHugeBlock(t *testing.T) {
+	b := new(ngBuilder)
+	b.section()
+	b.iface(int(layers.LinkTypeEthernet), "eth0")
+	binary.Write(b, binary.LittleEndian, uint32(ngBlockEnhancedPacket))
+	binary.Write(b, binary.LittleEndian, uint32(0xfffffff0))
+	b.Write(make([]byte, 32))
+
+	source, err := OpenReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a limit, this tries to read 4GiB, and finds the file truncated
+	if _, err := source.NextPacket(); err == nil || err == io.EOF || err == ErrTruncated {
+		t.Errorf("Corrupt block length not caught: %v", err)
+	}
+}
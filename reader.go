@@ -0,0 +1,95 @@
+package netshovel
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrGap is returned by a StreamReader with no fill bytes, when it reaches a gap
+//
+// The gap is skipped, so the next Read picks up after it.
+var ErrGap = errors.New("Data missing from stream")
+
+// A StreamReader lets a Stream be used anywhere an io.Reader can
+//
+// Use Stream.AsReader to make one.
+// This lets you hand a Stream to bufio, encoding/binary, compress/flate,
+// and anything else that reads from an io.Reader.
+// Don't mix calls to this with calls to Stream.Read,
+// unless you know where each one left off.
+type StreamReader struct {
+	stream *Stream
+	fill   []byte
+	when   time.Time
+}
+
+// AsReader returns an io.Reader for the rest of the Stream
+//
+// Gaps are filled with fill, like GapString.Bytes does.
+// If you don't provide any fill bytes, reading a gap returns ErrGap instead.
+func (stream *Stream) AsReader(fill ...byte) *StreamReader {
+	return &StreamReader{
+		stream: stream,
+		fill:   fill,
+	}
+}
+
+// Read reads up to len(p) bytes into p
+//
+// At the end of the Stream, this returns io.EOF.
+func (r *StreamReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	next, err := r.stream.Peek(-1)
+	if err == io.EOF {
+		r.stream.Done()
+		return 0, io.EOF
+	} else if err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+	if avail := next.Data.Length(); n > avail {
+		n = avail
+	}
+	if len(r.fill) == 0 && next.Data.Slice(0, n).Missing() > 0 {
+		// Stop at the gap, or if we're already there, skip it
+		gap := 0
+		for gap < next.Data.Length() && next.Data.ValueAt(gap) == -1 {
+			gap++
+		}
+		if gap > 0 {
+			u, _ := r.stream.Read(gap)
+			r.when = u.When
+			return 0, ErrGap
+		}
+		n = 0
+		for next.Data.ValueAt(n) != -1 {
+			n++
+		}
+	}
+
+	u, err := r.stream.Read(n)
+	if err != nil {
+		return 0, err
+	}
+	r.when = u.WhenAt(n - 1)
+	return copy(p, u.Data.Bytes(r.fill...)), nil
+}
+
+// ReadByte reads a single byte
+func (r *StreamReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := r.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// When returns when the most recently read byte was captured
+func (r *StreamReader) When() time.Time {
+	return r.when
+}
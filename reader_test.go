@@ -0,0 +1,43 @@
+package netshovel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dirtbags/netshovel/gapstring"
+)
+
+func TestStreamReader(t *testing.T) {
+	stream := testStream(
+		gapstring.OfBytes([]byte{0, 0, 0, 42, 'h', 'i'}),
+		gapstring.OfString("\n").AppendGap(3).AppendString("end"),
+	)
+	r := stream.AsReader()
+
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil || n != 42 {
+		t.Errorf("binary.Read: %d %v", n, err)
+	}
+	line, err := bufio.NewReader(io.LimitReader(r, 3)).ReadString('\n')
+	if err != nil || line != "hi\n" {
+		t.Errorf("bufio: %q %v", line, err)
+	}
+	if !r.When().Equal(time.Unix(1500000001, 0)) {
+		t.Errorf("Wrong time for last byte: %v", r.When())
+	}
+	if _, err := r.ReadByte(); err != ErrGap {
+		t.Errorf("Expected ErrGap, got %v", err)
+	}
+	if rest, err := ioutil.ReadAll(r); err != nil || string(rest) != "end" {
+		t.Errorf("After the gap: %q %v", rest, err)
+	}
+
+	stream = testStream(gapstring.OfString("a").AppendGap(2).AppendString("b"))
+	if all, err := ioutil.ReadAll(stream.AsReader('?')); err != nil || string(all) != "a??b" {
+		t.Errorf("Filled gaps: %q %v", all, err)
+	}
+}
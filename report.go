@@ -0,0 +1,110 @@
+package netshovel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ErrTruncated is reported when a capture ends partway through a packet
+var ErrTruncated = errors.New("capture ends partway through a packet")
+
+// An UnsupportedLinkTypeError is returned for packets from an interface gopacket can't decode
+//
+// This isn't fatal: packets from other interfaces can still be shoveled.
+type UnsupportedLinkTypeError struct {
+	LinkType int
+}
+
+func (e *UnsupportedLinkTypeError) Error() string {
+	return fmt.Sprintf("Unsupported link type %d", e.LinkType)
+}
+
+// supportedLinkType returns true if gopacket can decode a link type
+func supportedLinkType(linkType int) bool {
+	if linkType < 0 || linkType > 0xff {
+		return false
+	}
+	_, bad := layers.LinkTypeMetadata[linkType].DecodeWith.(error)
+	return !bad
+}
+
+// skippable returns true for errors that only affect a single packet
+func skippable(err error) bool {
+	var lte *UnsupportedLinkTypeError
+	return errors.As(err, &lte)
+}
+
+// A CaptureError describes a problem with one capture
+type CaptureError struct {
+	Name string // File name, or "iface:" and an interface name
+	Err  error
+}
+
+func (e *CaptureError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *CaptureError) Unwrap() error {
+	return e.Err
+}
+
+// A Report describes how a call to ShovelWithOptions went
+type Report struct {
+	Captures  int             // How many captures were opened
+	Errors    []*CaptureError // Problems encountered along the way
+	Fragments FragmentStats   // What happened to fragmented IP packets
+	Decoders  []*StreamError  // Problems decoding streams, if factory was a DecoderFactory
+}
+
+// add records a problem with a capture
+func (r *Report) add(name string, err error) {
+	r.Errors = append(r.Errors, &CaptureError{name, err})
+}
+
+// reportingSource records errors from a PacketSource in a Report, instead of returning them
+//
+// Fatal errors end the source,
+// so a bad file doesn't stop anything else from being shoveled.
+type reportingSource struct {
+	PacketSource
+	name    string
+	record  func(name string, err error) // Usually Report.add
+	skipped map[string]bool
+}
+
+func newReportingSource(source PacketSource, name string, record func(name string, err error)) *reportingSource {
+	return &reportingSource{
+		PacketSource: source,
+		name:         name,
+		record:       record,
+		skipped:      make(map[string]bool),
+	}
+}
+
+func (s *reportingSource) NextPacket() (gopacket.Packet, error) {
+	for {
+		packet, err := s.PacketSource.NextPacket()
+		if err == nil || err == io.EOF {
+			return packet, err
+		}
+		if skippable(err) {
+			// Only report each kind of skipped packet once
+			if !s.skipped[err.Error()] {
+				s.skipped[err.Error()] = true
+				s.record(s.name, err)
+			}
+			continue
+		}
+		s.record(s.name, err)
+		return nil, io.EOF
+	}
+}
+
+func (s *reportingSource) Live() bool {
+	return isLive(s.PacketSource)
+}
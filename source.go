@@ -0,0 +1,189 @@
+package netshovel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// ErrNoLibpcap is returned when netshovel was built without cgo,
+// and you asked for something only libpcap can do.
+var ErrNoLibpcap = errors.New("netshovel was built without libpcap (cgo)")
+
+// A PacketSource provides packets to be shoveled
+//
+// NextPacket returns io.EOF when there are no more packets.
+// *gopacket.PacketSource satisfies this interface,
+// so anything gopacket can read from can be shoveled.
+//
+// If a PacketSource also has a Live() method returning true,
+// idle streams are flushed periodically while it is being shoveled.
+type PacketSource interface {
+	NextPacket() (gopacket.Packet, error)
+}
+
+// liveSource is implemented by PacketSources that capture as traffic arrives
+type liveSource interface {
+	Live() bool
+}
+
+func isLive(source PacketSource) bool {
+	if ls, ok := source.(liveSource); ok {
+		return ls.Live()
+	}
+	return false
+}
+
+// PacketSlice is a PacketSource which hands out packets from memory
+//
+// This is mostly useful for testing decoders.
+type PacketSlice []gopacket.Packet
+
+// NextPacket removes and returns the first packet in the slice
+func (s *PacketSlice) NextPacket() (gopacket.Packet, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	packet := (*s)[0]
+	*s = (*s)[1:]
+	return packet, nil
+}
+
+// PacketChannel is a PacketSource which reads packets from a channel, until it is closed
+//
+// Use this to feed netshovel from your own packet source.
+type PacketChannel <-chan gopacket.Packet
+
+// NextPacket returns the next packet sent on the channel
+func (c PacketChannel) NextPacket() (gopacket.Packet, error) {
+	packet, more := <-c
+	if !more {
+		return nil, io.EOF
+	}
+	return packet, nil
+}
+
+// A CaptureSource is a PacketSource reading from a capture file or network interface
+//
+// Packets are decoded according to the link type of the interface that captured them,
+// so pcapng files with several kinds of interface work properly.
+// You must call Close when you're done with it.
+type CaptureSource struct {
+	reader   gopacket.PacketDataSource
+	linkType layers.LinkType // Used when packets don't come with a CaptureNote
+	closer   io.Closer
+	live     bool
+}
+
+// NextPacket reads and decodes the next packet
+func (s *CaptureSource) NextPacket() (gopacket.Packet, error) {
+	data, ci, err := s.reader.ReadPacketData()
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncated
+	} else if err != nil {
+		return nil, err
+	}
+
+	linkType := s.linkType
+	if note := noteOf(ci); note != nil {
+		linkType = note.LinkType
+	}
+	if !supportedLinkType(int(linkType)) {
+		return nil, &UnsupportedLinkTypeError{int(linkType)}
+	}
+	packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+	m := packet.Metadata()
+	m.CaptureInfo = ci
+	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+	return packet, nil
+}
+
+// Live returns true if this source is capturing from a network interface
+func (s *CaptureSource) Live() bool {
+	return s.live
+}
+
+// Close closes the underlying file or network interface
+func (s *CaptureSource) Close() error {
+	return s.closer.Close()
+}
+
+// pcapngMagic is the block type of a pcapng Section Header Block
+const pcapngMagic = 0x0a0d0d0a
+
+// OpenFile opens a pcap or pcapng file for reading, without using libpcap
+//
+// The file format and compression (gzip, zstd, xz, or bzip2)
+// are determined from the contents of the file,
+// not its name.
+// A filename of "-" reads from standard input.
+func OpenFile(filename string) (*CaptureSource, error) {
+	f := os.Stdin
+	if filename != "-" {
+		var err error
+		if f, err = os.Open(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	source, err := newCaptureSource(f, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+// OpenReader reads a pcap or pcapng file from r, which may be compressed
+//
+// Closing the returned CaptureSource does not close r.
+func OpenReader(r io.Reader) (*CaptureSource, error) {
+	return newCaptureSource(r, nil)
+}
+
+// newCaptureSource sets up a pure-Go reader for whatever capture format r contains
+//
+// If closer isn't nil, it's closed along with the CaptureSource.
+func newCaptureSource(r io.Reader, closer io.Closer) (*CaptureSource, error) {
+	dr, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	source := &CaptureSource{
+		closer: closers{dr},
+	}
+	if closer != nil {
+		source.closer = closers{dr, closer}
+	}
+
+	br := bufio.NewReader(dr)
+	magic, err := br.Peek(4)
+	if err != nil {
+		dr.Close()
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(magic) == pcapngMagic {
+		ng, err := newNgReader(br)
+		if err != nil {
+			dr.Close()
+			return nil, err
+		}
+		source.reader = ng
+	} else {
+		pc, err := pcapgo.NewReader(br)
+		if err != nil {
+			dr.Close()
+			return nil, err
+		}
+		source.reader = pc
+		source.linkType = pc.LinkType()
+	}
+	return source, nil
+}
@@ -1,11 +1,14 @@
 package netshovel
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dirtbags/netshovel/gapstring"
@@ -30,13 +33,102 @@ type NamedFile struct {
 type Utterance struct {
 	When time.Time
 	Data gapstring.GapString
+
+	// Which half of the Conversation this came from
+	Direction Direction
+
+	// Where each TCP segment or UDP datagram starts in Data, in order
+	Marks []Mark
+
+	// These are only filled in if the capture file recorded them
+	Interface string   // Name of the capturing interface
+	Comments  []string // Comments attached to packets in this Utterance
+}
+
+// A Mark notes where a TCP segment or UDP datagram starts within an Utterance
+//
+// This tells you how the sender split up its writes,
+// and, with Utterance.WhenAt, when any byte showed up.
+type Mark struct {
+	Offset  int       // Where in Data this segment starts
+	When    time.Time // When this segment was captured
+	Segment int       // Which segment of the Stream this is, counting from 0
+}
+
+// WhenAt returns when the byte at offset in u.Data was captured
+//
+// If u has no Marks covering offset, this returns u.When.
+func (u Utterance) WhenAt(offset int) time.Time {
+	when := u.When
+	for _, m := range u.Marks {
+		if m.Offset > offset {
+			break
+		}
+		when = m.When
+	}
+	return when
+}
+
+// shiftMarks returns marks moved along by n bytes
+func shiftMarks(marks []Mark, n int) []Mark {
+	ret := make([]Mark, 0, len(marks))
+	for _, m := range marks {
+		m.Offset += n
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// sliceMarks returns the marks for Data.Slice(start, end)
+//
+// A segment which began before start now begins at 0.
+func sliceMarks(marks []Mark, start, end int) []Mark {
+	var ret []Mark
+	for i, m := range marks {
+		if m.Offset >= end {
+			break
+		}
+		if m.Offset < start {
+			if i+1 < len(marks) && marks[i+1].Offset <= start {
+				continue
+			}
+			m.Offset = start
+		}
+		m.Offset -= start
+		ret = append(ret, m)
+	}
+	return ret
 }
 
 // A Stream is one half of a two-way conversation
 type Stream struct {
 	Net, Transport gopacket.Flow
-	conversation   chan Utterance
-	pending        Utterance
+
+	// Tunnels this stream was unwrapped from, outermost first.
+	// This is set by the time the first Read returns.
+	Tunnels []Encapsulation
+
+	conversation *queue
+	pending      Utterance
+	assembler    *Assembler
+
+	conv               *Conversation
+	role               Role
+	direction          Direction
+	decodeConversation func(*Conversation) // Set by ConversationFactory
+
+	// These are only used by the Assembler
+	seqEnd         uint32 // Furthest TCP sequence number seen
+	seqSeen        bool
+	sawFIN, sawRST bool
+	ended          bool // Reassembly has delivered a FIN or RST
+	started        bool // Reassembly has delivered something
+	midstream      bool
+
+	lock     sync.Mutex
+	done     chan struct{} // Closed when the decoder is finished with this stream
+	finished bool
+	info     StreamInfo
 }
 
 // NewStream returns a newly-built Stream
@@ -47,7 +139,84 @@ func NewStream(net, transport gopacket.Flow) *Stream {
 	return &Stream{
 		Net:          net,
 		Transport:    transport,
-		conversation: make(chan Utterance, 100),
+		conversation: newQueue(),
+		role:         guessRole(transport),
+		done:         make(chan struct{}),
+	}
+}
+
+// attach introduces this stream to the Assembler building it
+func (stream *Stream) attach(assembler *Assembler) {
+	stream.lock.Lock()
+	stream.assembler = assembler
+	stream.Tunnels = assembler.outer
+	assembler.setUp(stream.conversation)
+	if !stream.finished {
+		assembler.decoders.Add(1)
+	}
+	late := assembler.pair(stream)
+	stream.lock.Unlock()
+	if late {
+		// Nobody is left to read this half
+		stream.Done()
+	}
+}
+
+// Role returns which side of the conversation this Stream comes from
+//
+// If the Assembler saw a SYN or SYN-ACK, it knows for sure;
+// otherwise this is a guess, based on port numbers.
+// Like Tunnels, this is settled by the time your first Read returns.
+func (stream *Stream) Role() Role {
+	return stream.role
+}
+
+// endpoints returns the network and transport endpoints of the client, then the server
+//
+// If it's not known which side is which, the source comes first.
+func (stream *Stream) endpoints() (clientNet, clientPort, serverNet, serverPort gopacket.Endpoint) {
+	if stream.role == ServerRole {
+		return stream.Net.Dst(), stream.Transport.Dst(), stream.Net.Src(), stream.Transport.Src()
+	}
+	return stream.Net.Src(), stream.Transport.Src(), stream.Net.Dst(), stream.Transport.Dst()
+}
+
+// Midstream returns true if this Stream was picked up partway through
+//
+// This happens when the capture started after the connection was set up,
+// or the SYN was lost.
+// Your decoder can't trust its first bytes to line up with anything,
+// and may want to resynchronize, for instance with SeekPattern.
+// Like Tunnels, this is settled by the time your first Read returns.
+func (stream *Stream) Midstream() bool {
+	return stream.midstream
+}
+
+// Conversation returns the Conversation this Stream is half of
+//
+// Like Tunnels, this is set by the time your first Read returns.
+// It's nil if the Stream wasn't built by an Assembler.
+func (stream *Stream) Conversation() *Conversation {
+	return stream.conv
+}
+
+// Done tells netshovel your decoder is finished with this Stream
+//
+// Reading to the end of the Stream does this for you.
+// If your decoder gives up early, call Done,
+// so the rest of the Stream is thrown away instead of piling up,
+// and Shovel doesn't wait for you forever.
+func (stream *Stream) Done() {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if stream.finished {
+		return
+	}
+	stream.finished = true
+	close(stream.done)
+	stream.conversation.discard()
+	if stream.assembler != nil {
+		stream.assembler.decoders.Done()
 	}
 }
 
@@ -56,28 +225,122 @@ func (stream *Stream) Reassembled(rs []tcpassembly.Reassembly) {
 	ret := Utterance{
 		When: rs[0].Seen,
 	}
+	if !stream.started {
+		// tcpassembly sets Skip to -1 if it never saw a SYN
+		stream.started = true
+		stream.midstream = rs[0].Skip == -1
+	}
 	for _, r := range rs {
+		stream.seen(r.Seen)
 		if r.Skip > 0 {
 			ret.Data = ret.Data.AppendGap(r.Skip)
 		}
+		if len(r.Bytes) > 0 {
+			ret.Marks = append(ret.Marks, stream.mark(ret.Data.Length(), r.Seen))
+		}
 		ret.Data = ret.Data.AppendBytes(r.Bytes)
+		stream.ended = stream.ended || r.End
+	}
+	stream.lock.Lock()
+	stream.info.Bytes += ret.Data.Length() - ret.Data.Missing()
+	stream.info.Missing += ret.Data.Missing()
+	stream.lock.Unlock()
+	if stream.assembler != nil {
+		stream.annotate(&ret, rs)
 	}
 
 	// Throw away utterances with no data (SYN, ACK, FIN, &c)
 	if ret.Data.Length() > 0 {
-		stream.conversation <- ret
+		stream.send(ret)
+	}
+}
+
+// Datagram is called by the Assembler with each datagram in a UDP flow
+//
+// Every datagram becomes its own Utterance.
+func (stream *Stream) Datagram(when time.Time, payload []byte) {
+	stream.seen(when)
+	u := Utterance{
+		When:  when,
+		Data:  gapstring.OfBytes(payload),
+		Marks: []Mark{stream.mark(0, when)},
+	}
+	stream.lock.Lock()
+	stream.info.Bytes += len(payload)
+	stream.lock.Unlock()
+	if stream.assembler != nil {
+		stream.annotate(&u, nil)
+	}
+	stream.send(u)
+}
+
+// mark returns a Mark for the next segment, starting at offset
+func (stream *Stream) mark(offset int, when time.Time) Mark {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	m := Mark{Offset: offset, When: when, Segment: stream.info.Segments}
+	stream.info.Segments++
+	return m
+}
+
+// send sends an Utterance to the decoder
+//
+// If the decoder is reading a whole Conversation, it goes there instead.
+func (stream *Stream) send(u Utterance) {
+	u.Direction = stream.direction
+	out := stream.conversation
+	if stream.conv != nil && stream.conv.utterances != nil {
+		out = stream.conv.utterances
+	}
+	out.put(u, stream.done)
+}
+
+// annotate adds anything the capture file said about the packet being assembled
+//
+// rs is nil for UDP datagrams, which are always the whole packet.
+func (stream *Stream) annotate(u *Utterance, rs []tcpassembly.Reassembly) {
+	packet := stream.assembler.packet
+	if packet == nil {
+		return
+	}
+	note := noteOf(packet.Metadata().CaptureInfo)
+	if note == nil {
+		return
+	}
+
+	u.Interface = note.Interface
+	if rs == nil {
+		u.Comments = append(u.Comments, note.Comments...)
+		return
+	}
+	// Out-of-order data can be delivered alongside this packet's data,
+	// but comments only belong with this packet.
+	for _, r := range rs {
+		if r.Seen.Equal(packet.Metadata().Timestamp) {
+			u.Comments = append(u.Comments, note.Comments...)
+			break
+		}
 	}
 }
 
-// ReassemblyComplete is called by the TCP assemble when the Stream is closed
+// ReassemblyComplete is called by the Assembler when the Stream is closed
 func (stream *Stream) ReassemblyComplete() {
-	close(stream.conversation)
+	reason := stream.closeReason()
+	stream.lock.Lock()
+	stream.info.Closed = reason
+	stream.lock.Unlock()
+
+	stream.conversation.close()
+	if stream.conv != nil {
+		stream.assembler.finish(stream)
+	}
 }
 
 // Read an utterance of a particular size
 //
 // If you pass in a length of -1,
 // this returns utterances as they appear in the conversation.
+// For UDP, that's one datagram at a time.
 //
 // At first, your decoder will probably want to use a length of -1:
 // this will give you a sense of how the conversation works.
@@ -86,6 +349,13 @@ func (stream *Stream) ReassemblyComplete() {
 // so that if you have a large application-layer packet,
 // or multiple application-layer packets in a single transport-layer packet,
 // your decoder handles it properly.
+//
+// When the result is put together from several utterances,
+// When is the time of the last one,
+// and Marks says where each segment begins, and when it was captured.
+//
+// If your decoder fell behind and the Assembler's Backpressure is BackpressureAbort,
+// this returns ErrDecoderTooSlow.
 func (stream *Stream) Read(length int) (Utterance, error) {
 	// This probably indicates a problem, but we assume you know what you're doing
 	if length == 0 {
@@ -99,12 +369,13 @@ func (stream *Stream) Read(length int) (Utterance, error) {
 		if stream.pending.Data.Length() > 0 {
 			ret = stream.pending
 			stream.pending.Data = gapstring.GapString{}
+			stream.pending.Comments = nil
+			stream.pending.Marks = nil
 		} else {
-			r, more := <-stream.conversation
-			if !more {
-				err = io.EOF
+			ret, err = stream.conversation.get()
+			if err != nil {
+				stream.Done()
 			}
-			ret = r
 		}
 		return ret, err
 	}
@@ -112,17 +383,17 @@ func (stream *Stream) Read(length int) (Utterance, error) {
 	// Pull in utterances until we have enough data.
 	// .When will always be the timestamp on the last received utterance
 	for stream.pending.Data.Length() < length {
-		u, more := <-stream.conversation
-		if !more {
+		if err := stream.fill(); err == io.EOF {
 			break
+		} else if err != nil {
+			return Utterance{}, err
 		}
-		stream.pending.Data = stream.pending.Data.Append(u.Data)
-		stream.pending.When = u.When
 	}
 
 	pendingLen := stream.pending.Data.Length()
 	// If we got nothing, it's the end of the stream
 	if pendingLen == 0 {
+		stream.Done()
 		return Utterance{}, io.EOF
 	}
 
@@ -131,22 +402,257 @@ func (stream *Stream) Read(length int) (Utterance, error) {
 		sliceLen = pendingLen
 	}
 	ret := Utterance{
-		Data: stream.pending.Data.Slice(0, sliceLen),
-		When: stream.pending.When,
+		Data:      stream.pending.Data.Slice(0, sliceLen),
+		When:      stream.pending.When,
+		Direction: stream.pending.Direction,
+		Interface: stream.pending.Interface,
+		Comments:  stream.pending.Comments,
+		Marks:     sliceMarks(stream.pending.Marks, 0, sliceLen),
 	}
 	stream.pending.Data = stream.pending.Data.Slice(sliceLen, pendingLen)
+	stream.pending.Comments = nil
+	stream.pending.Marks = sliceMarks(stream.pending.Marks, sliceLen, pendingLen)
+	return ret, nil
+}
+
+// Peek returns the next length bytes, without consuming them
+//
+// The next Read will return the same data.
+// Like Read, a length of -1 returns the next utterance as it appears in the conversation.
+// If the stream ends before length bytes show up,
+// this returns whatever is left,
+// or, like Read, io.EOF if nothing is.
+func (stream *Stream) Peek(length int) (Utterance, error) {
+	want := length
+	if length == -1 {
+		want = 1
+	}
+	for stream.pending.Data.Length() < want {
+		if err := stream.fill(); err == io.EOF {
+			break
+		} else if err != nil {
+			return Utterance{}, err
+		}
+	}
+
+	pendingLen := stream.pending.Data.Length()
+	if pendingLen == 0 && length != 0 {
+		stream.Done()
+		return Utterance{}, io.EOF
+	}
+	if length == -1 || length > pendingLen {
+		length = pendingLen
+	}
+	ret := stream.pending
+	ret.Data = ret.Data.Slice(0, length)
+	ret.Marks = sliceMarks(ret.Marks, 0, length)
 	return ret, nil
 }
 
+// Unread pushes u back onto the front of the stream
+//
+// The next Read or Peek will start with u.Data.
+// Use this when your decoder has read too far,
+// or has read something it wants to hand off to another part of the decoder.
+func (stream *Stream) Unread(u Utterance) {
+	if stream.pending.Data.Length() == 0 {
+		stream.pending = u
+		return
+	}
+	stream.pending.Marks = append(shiftMarks(u.Marks, 0), shiftMarks(stream.pending.Marks, u.Data.Length())...)
+	stream.pending.Data = gapstring.New().Append(u.Data).Append(stream.pending.Data)
+	stream.pending.Comments = append(u.Comments[:len(u.Comments):len(u.Comments)], stream.pending.Comments...)
+	if u.Interface != "" {
+		stream.pending.Interface = u.Interface
+	}
+}
+
+// fill pulls the next Utterance onto the end of the pending data
+//
+// At the end of the stream, this returns io.EOF.
+func (stream *Stream) fill() error {
+	u, err := stream.conversation.get()
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		stream.Done()
+		return err
+	}
+	stream.pending.Marks = append(stream.pending.Marks, shiftMarks(u.Marks, stream.pending.Data.Length())...)
+	stream.pending.Data = stream.pending.Data.Append(u.Data)
+	stream.pending.When = u.When
+	stream.pending.Direction = u.Direction
+	stream.pending.Comments = append(stream.pending.Comments, u.Comments...)
+	if stream.pending.Interface == "" {
+		stream.pending.Interface = u.Interface
+	}
+	return nil
+}
+
+// ErrTooLong is returned when a delimiter doesn't show up soon enough
+var ErrTooLong = errors.New("Delimiter not found within maximum length")
+
+// ReadUntil reads up to and including the first delim
+//
+// The search carries on across Utterances,
+// but delim never matches across a gap.
+// If delim isn't found in the first max bytes,
+// those max bytes are returned with ErrTooLong,
+// so a protocol that's gone wrong can't make you buffer forever.
+// A max of 0 means there's no limit.
+//
+// If the stream ends before delim shows up,
+// whatever was left is returned with io.ErrUnexpectedEOF,
+// and, like io.EOF from Read, the Stream is marked Done.
+func (stream *Stream) ReadUntil(delim []byte, max int) (Utterance, error) {
+	return stream.ReadUntilAny([][]byte{delim}, max)
+}
+
+// ReadUntilAny reads up to and including whichever of delims shows up first
+//
+// If two delimiters start at the same place, the longer one wins.
+// Otherwise this works just like ReadUntil.
+func (stream *Stream) ReadUntilAny(delims [][]byte, max int) (Utterance, error) {
+	for {
+		data := stream.pending.Data
+		start, end := -1, -1
+		for _, delim := range delims {
+			i := data.Index(delim)
+			if i < 0 {
+				continue
+			}
+			if start < 0 || i < start || (i == start && i+len(delim) > end) {
+				start, end = i, i+len(delim)
+			}
+		}
+
+		switch {
+		case end >= 0 && (max == 0 || end <= max):
+			return stream.Read(end)
+		case max > 0 && data.Length() >= max:
+			u, err := stream.Read(max)
+			if err == nil {
+				err = ErrTooLong
+			}
+			return u, err
+		}
+
+		if err := stream.fill(); err == io.EOF {
+			u, err := stream.Read(data.Length() + 1)
+			if err == nil {
+				// There's nothing left, so this is as finished as io.EOF
+				stream.Done()
+				err = io.ErrUnexpectedEOF
+			}
+			return u, err
+		} else if err != nil {
+			return Utterance{}, err
+		}
+	}
+}
+
+// ReadLine reads a line of text, ending with either CRLF or LF
+//
+// The line ending is left off what's returned.
+// Like ReadUntil, this gives up after max bytes, including the line ending.
+func (stream *Stream) ReadLine(max int) (Utterance, error) {
+	u, err := stream.ReadUntil([]byte("\n"), max)
+	if err != nil {
+		return u, err
+	}
+	end := u.Data.Length() - 1
+	if end > 0 && u.Data.ValueAt(end-1) == '\r' {
+		end--
+	}
+	u.Data = u.Data.Slice(0, end)
+	u.Marks = sliceMarks(u.Marks, 0, end)
+	return u, nil
+}
+
+// ErrNoPattern is returned when SeekPattern doesn't find its pattern soon enough
+var ErrNoPattern = errors.New("Pattern not found within maximum scan length")
+
+// SeekPattern throws away data until pattern shows up
+//
+// This lets your decoder find its framing again after a gap,
+// or in a Stream picked up partway through.
+// The next Read starts with pattern.
+// Everything thrown away is returned:
+// its Data.Length() is how many bytes were skipped,
+// and Data.Missing() is how many of those bytes were lost,
+// added up over every gap along the way.
+// Like Index on a GapString, pattern never matches across a gap.
+//
+// If pattern doesn't start within the first maxScan bytes,
+// those bytes are thrown away, and ErrNoPattern is returned.
+// A maxScan of 0 means there's no limit.
+// If the stream ends first, everything is thrown away, io.EOF is returned,
+// and the Stream is marked Done.
+func (stream *Stream) SeekPattern(pattern []byte, maxScan int) (Utterance, error) {
+	return stream.seek(maxScan, len(pattern), func(data gapstring.GapString) int {
+		return data.Index(pattern)
+	})
+}
+
+// SeekRegexp throws away data until something matching re shows up
+//
+// This works like SeekPattern.
+// Since a regular expression can match any amount of data,
+// re is only matched against what's arrived so far,
+// so if a later part of re might only show up in the next segment,
+// keep re simple.
+func (stream *Stream) SeekRegexp(re *regexp.Regexp, maxScan int) (Utterance, error) {
+	return stream.seek(maxScan, 1, func(data gapstring.GapString) int {
+		return data.IndexRegexp(re)
+	})
+}
+
+// seek throws away data up to wherever find says
+//
+// A match must start within maxScan bytes,
+// and can only be ruled out once it has had room bytes to show up in.
+func (stream *Stream) seek(maxScan, room int, find func(gapstring.GapString) int) (Utterance, error) {
+	for {
+		data := stream.pending.Data
+		i := find(data)
+		switch {
+		case i >= 0 && (maxScan == 0 || i <= maxScan):
+			return stream.Read(i)
+		case maxScan > 0 && data.Length() >= maxScan+room:
+			u, err := stream.Read(maxScan)
+			if err == nil {
+				err = ErrNoPattern
+			}
+			return u, err
+		}
+
+		if err := stream.fill(); err == io.EOF {
+			u, _ := stream.Read(data.Length())
+			stream.Done()
+			return u, io.EOF
+		} else if err != nil {
+			return Utterance{}, err
+		}
+	}
+}
+
 // Describe returns a string description of a packet
 //
-// This just prefixes our source and dest IP:Port to pkt.Describe()
+// This just prefixes the client and server IP:Port to pkt.Describe(),
+// with an arrow showing which way the packet went.
+// The client always comes first, so both halves of a conversation line up.
 func (stream *Stream) Describe(pkt Packet) string {
 	out := new(strings.Builder)
 
-	fmt.Fprintf(out, "%v:%v → %v:%v\n",
-		stream.Net.Src().String(), stream.Transport.Src().String(),
-		stream.Net.Dst().String(), stream.Transport.Dst().String(),
+	arrow := "→"
+	if stream.role == ServerRole {
+		arrow = "←"
+	}
+	clientNet, clientPort, serverNet, serverPort := stream.endpoints()
+	fmt.Fprintf(out, "%v:%v %s %v:%v\n",
+		clientNet.String(), clientPort.String(),
+		arrow,
+		serverNet.String(), serverPort.String(),
 	)
 	out.WriteString(pkt.Describe())
 	return out.String()
@@ -160,12 +666,17 @@ func (stream *Stream) Describe(pkt Packet) string {
 //
 // Best practice is to pass in as full a path as you can find,
 // including drive letters and all parent directories.
+//
+// The client's address comes first, then the server's,
+// then the Role of whichever one sent the file.
 func (stream *Stream) CreateFile(when time.Time, path string) (NamedFile, error) {
+	clientNet, clientPort, serverNet, serverPort := stream.endpoints()
 	name := fmt.Sprintf(
-		"xfer/%s,%sp%s,%sp%s,%s",
+		"xfer/%s,%sp%s,%sp%s,%s,%s",
 		when.UTC().Format(time.RFC3339Nano),
-		stream.Net.Src().String(), stream.Transport.Src().String(),
-		stream.Net.Dst().String(), stream.Transport.Dst().String(),
+		clientNet.String(), clientPort.String(),
+		serverNet.String(), serverPort.String(),
+		stream.role,
 		url.PathEscape(path),
 	)
 	f, err := os.Create(name)
@@ -0,0 +1,167 @@
+package netshovel
+
+import (
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/dirtbags/netshovel/gapstring"
+	"github.com/google/gopacket"
+)
+
+// testStream returns a finished Stream made of utterances
+func testStream(utterances ...gapstring.GapString) *Stream {
+	stream := NewStream(gopacket.Flow{}, gopacket.Flow{})
+	when := time.Unix(1500000000, 0)
+	go func() {
+		for i, data := range utterances {
+			stream.send(Utterance{When: when.Add(time.Duration(i) * time.Second), Data: data})
+		}
+		stream.ReassemblyComplete()
+	}()
+	return stream
+}
+
+func TestReadUntil(t *testing.T) {
+	stream := testStream(
+		gapstring.OfString("HELO example.com\r"),
+		gapstring.OfString("\nMAIL FROM:<a@example.com>\nDA"),
+		gapstring.OfString("TA\r\n").AppendGap(4).AppendString("\nQUIT"),
+	)
+
+	expected := []string{"HELO example.com", "MAIL FROM:<a@example.com>", "DATA", "????"}
+	for _, e := range expected {
+		u, err := stream.ReadLine(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := u.Data.String("?"); s != e {
+			t.Errorf("Expected %q, got %q", e, s)
+		}
+	}
+	if u, err := stream.ReadLine(100); err != io.ErrUnexpectedEOF || u.Data.String("") != "QUIT" {
+		t.Errorf("Wrong last line: %q %v", u.Data.String(""), err)
+	}
+	if !closed(stream.done) {
+		t.Error("Stream not Done after its last line")
+	}
+	if _, err := stream.ReadLine(100); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	stream = testStream(gapstring.OfString("a;b,c"), gapstring.OfString("ccccc;d"))
+	u, err := stream.ReadUntilAny([][]byte{[]byte(","), []byte(";")}, 5)
+	if err != nil || u.Data.String("") != "a;" {
+		t.Errorf("ReadUntilAny: %q %v", u.Data.String(""), err)
+	}
+	u, err = stream.ReadUntil([]byte(";"), 5)
+	if err != ErrTooLong || u.Data.String("") != "b,ccc" {
+		t.Errorf("Runaway ReadUntil: %q %v", u.Data.String(""), err)
+	}
+	u, err = stream.ReadUntil([]byte(";"), 0)
+	if err != nil || u.Data.String("") != "ccc;" {
+		t.Errorf("Unlimited ReadUntil: %q %v", u.Data.String(""), err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	stream := testStream(gapstring.OfString("HK"), gapstring.OfString("12345"))
+
+	u, err := stream.Peek(4)
+	if err != nil || u.Data.String("") != "HK12" {
+		t.Errorf("Peek: %q %v", u.Data.String(""), err)
+	}
+	u, err = stream.Read(3)
+	if err != nil || u.Data.String("") != "HK1" {
+		t.Errorf("Read after Peek: %q %v", u.Data.String(""), err)
+	}
+
+	stream.Unread(u)
+	u, err = stream.Peek(-1)
+	if err != nil || u.Data.String("") != "HK12345" {
+		t.Errorf("Peek after Unread: %q %v", u.Data.String(""), err)
+	}
+	u, err = stream.Peek(100)
+	if err != nil || u.Data.String("") != "HK12345" {
+		t.Errorf("Peek past the end: %q %v", u.Data.String(""), err)
+	}
+	stream.Read(100)
+	if _, err := stream.Peek(1); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	if !closed(stream.done) {
+		t.Error("Stream not Done after Peek hit the end")
+	}
+}
+
+func TestMarks(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	stream := NewStream(gopacket.Flow{}, gopacket.Flow{})
+	go func() {
+		stream.Datagram(when, []byte("abc"))
+		stream.Datagram(when.Add(1*time.Second), []byte("de"))
+		stream.Datagram(when.Add(2*time.Second), []byte("fgh"))
+		stream.ReassemblyComplete()
+	}()
+
+	u, err := stream.Read(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Mark{{0, when, 0}, {3, when.Add(1 * time.Second), 1}}
+	if len(u.Marks) != len(expected) {
+		t.Fatalf("Wrong marks: %v", u.Marks)
+	}
+	for i, m := range expected {
+		if u.Marks[i] != m {
+			t.Errorf("Mark %d: expected %v, got %v", i, m, u.Marks[i])
+		}
+	}
+	if !u.WhenAt(2).Equal(when) || !u.WhenAt(3).Equal(when.Add(1*time.Second)) {
+		t.Errorf("Wrong WhenAt: %v %v", u.WhenAt(2), u.WhenAt(3))
+	}
+
+	// The rest of the second datagram now starts at 0
+	u, err = stream.Read(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Marks) != 2 || u.Marks[0].Segment != 1 || u.Marks[1].Offset != 1 || u.Marks[1].Segment != 2 {
+		t.Errorf("Wrong marks after slicing: %v", u.Marks)
+	}
+}
+
+func TestSeekPattern(t *testing.T) {
+	stream := testStream(
+		gapstring.OfString("junk").AppendGap(3).AppendString("x").AppendGap(2).AppendString("MA"),
+		gapstring.OfString("GICdata MAGIC"),
+	)
+	skipped, err := stream.SeekPattern([]byte("MAGIC"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Missing counts bytes in both gaps, not the gaps themselves
+	if skipped.Data.Length() != 10 || skipped.Data.Missing() != 5 {
+		t.Errorf("Wrong amount skipped: %q", skipped.Data.String("?"))
+	}
+	if u, _ := stream.Read(9); u.Data.String("") != "MAGICdata" {
+		t.Errorf("Didn't stop at the pattern: %q", u.Data.String(""))
+	}
+
+	if skipped, err = stream.SeekRegexp(regexp.MustCompile("M[A-Z]+"), 0); err != nil || skipped.Data.String("") != " " {
+		t.Errorf("SeekRegexp: %q %v", skipped.Data.String(""), err)
+	}
+	stream.Unread(skipped)
+
+	// Patterns starting too far in aren't found
+	if skipped, err = stream.SeekPattern([]byte("GIC"), 2); err != ErrNoPattern || skipped.Data.String("") != " M" {
+		t.Errorf("Scan limit: %q %v", skipped.Data.String(""), err)
+	}
+	if skipped, err = stream.SeekPattern([]byte("nope"), 0); err != io.EOF || skipped.Data.String("") != "AGIC" {
+		t.Errorf("Scan to the end: %q %v", skipped.Data.String(""), err)
+	}
+	if !closed(stream.done) {
+		t.Error("Stream not Done after seeking to the end")
+	}
+}
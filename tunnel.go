@@ -0,0 +1,195 @@
+package netshovel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// A Tunnel is a kind of encapsulation that can be unwrapped before TCP reassembly
+//
+// Tunnels are bit flags, so you can combine them with |.
+type Tunnel uint
+
+// Kinds of Tunnel
+const (
+	TunnelGRE    Tunnel = 1 << iota // Generic Routing Encapsulation
+	TunnelVXLAN                     // Virtual eXtensible LAN
+	TunnelGTPU                      // GPRS Tunnelling Protocol, user plane
+	TunnelERSPAN                    // Encapsulated Remote SPAN, carried in GRE
+	TunnelIPinIP                    // IPv4 or IPv6 directly inside IPv4 or IPv6 (except 6in4)
+	Tunnel6in4                      // IPv6 directly inside IPv4
+
+	NoTunnels  Tunnel = 0
+	AllTunnels        = TunnelGRE | TunnelVXLAN | TunnelGTPU | TunnelERSPAN | TunnelIPinIP | Tunnel6in4
+)
+
+var tunnelNames = []struct {
+	tunnel Tunnel
+	name   string
+}{
+	{TunnelGRE, "gre"},
+	{TunnelVXLAN, "vxlan"},
+	{TunnelGTPU, "gtpu"},
+	{TunnelERSPAN, "erspan"},
+	{TunnelIPinIP, "ipip"},
+	{Tunnel6in4, "6in4"},
+}
+
+// String returns a comma-separated list of tunnel names, like "gre,vxlan"
+func (t Tunnel) String() string {
+	switch t {
+	case NoTunnels:
+		return "none"
+	case AllTunnels:
+		return "all"
+	}
+	var names []string
+	for _, tn := range tunnelNames {
+		if t&tn.tunnel != 0 {
+			names = append(names, tn.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Set parses a comma-separated list of tunnel names, "all", or "none"
+//
+// This lets you use a Tunnel as a command-line flag.
+func (t *Tunnel) Set(value string) error {
+	*t = NoTunnels
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "", "none":
+			continue
+		case "all":
+			*t |= AllTunnels
+			continue
+		}
+		found := false
+		for _, tn := range tunnelNames {
+			if name == tn.name {
+				*t |= tn.tunnel
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown tunnel type %q", name)
+		}
+	}
+	return nil
+}
+
+// An Encapsulation describes a tunnel a Stream was carried through
+type Encapsulation struct {
+	Tunnel Tunnel        // What kind of tunnel
+	Net    gopacket.Flow // Network endpoints of the tunnel
+}
+
+// ERSPAN rides on GRE with one of these protocol numbers
+const (
+	ethernetTypeERSPAN    layers.EthernetType = 0x88be // Types I and II
+	ethernetTypeERSPANIII layers.EthernetType = 0x22eb
+)
+
+// decapsulate finds the innermost TCP or UDP layer in a packet's layers, and the network layer carrying it
+//
+// Only the kinds of tunnel in tunnels are unwrapped:
+// if TCP is inside any other kind,
+// the UDP carrying the tunnel (if any) is returned instead.
+// Every tunnel unwrapped along the way is returned in outer, outermost first.
+func decapsulate(ls []gopacket.Layer, tunnels Tunnel) (net gopacket.NetworkLayer, transport gopacket.TransportLayer, outer []Encapsulation) {
+	var udp *layers.UDP
+	var udpNet gopacket.NetworkLayer
+	var udpOuter []Encapsulation
+	via := NoTunnels // Kind of tunnel seen since the last network layer
+walk:
+	for i := 0; i < len(ls); i++ {
+		switch l := ls[i].(type) {
+		case *layers.IPv4, *layers.IPv6:
+			inner := l.(gopacket.NetworkLayer)
+			if net != nil {
+				kind := via
+				if kind == NoTunnels {
+					kind = ipInIP(net, inner)
+				}
+				if tunnels&kind == 0 {
+					break walk
+				}
+				outer = append(outer, Encapsulation{kind, net.NetworkFlow()})
+			}
+			net = inner
+			via = NoTunnels
+		case *layers.GRE:
+			if l.Protocol == ethernetTypeERSPAN || l.Protocol == ethernetTypeERSPANIII {
+				via = TunnelERSPAN
+				if tunnels&via == 0 {
+					break walk
+				}
+				// gopacket doesn't know ERSPAN, so decode what it carries ourselves
+				frame := unwrapERSPAN(l)
+				if frame == nil {
+					break walk
+				}
+				inner := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+				ls = append(ls[:i+1:i+1], inner.Layers()...)
+			} else {
+				via = TunnelGRE
+			}
+		case *layers.VXLAN:
+			via = TunnelVXLAN
+		case *layers.GTPv1U:
+			via = TunnelGTPU
+		case *layers.TCP:
+			if net != nil {
+				return net, l, outer
+			}
+		case *layers.UDP:
+			if net != nil {
+				udp, udpNet, udpOuter = l, net, outer
+			}
+		}
+	}
+	if udp == nil {
+		return nil, nil, nil
+	}
+	return udpNet, udp, udpOuter
+}
+
+// ipInIP works out what kind of tunnel it is when one IP packet is right inside another
+func ipInIP(outer, inner gopacket.NetworkLayer) Tunnel {
+	if outer.LayerType() == layers.LayerTypeIPv4 && inner.LayerType() == layers.LayerTypeIPv6 {
+		return Tunnel6in4
+	}
+	return TunnelIPinIP
+}
+
+// unwrapERSPAN returns the Ethernet frame mirrored in an ERSPAN packet, or nil
+func unwrapERSPAN(gre *layers.GRE) []byte {
+	payload := gre.LayerPayload()
+	hlen := 0
+	switch {
+	case gre.Protocol == ethernetTypeERSPANIII:
+		// 12 bytes, plus an 8-byte platform-specific subheader if the O bit is set
+		hlen = 12
+		if len(payload) >= hlen && payload[11]&1 != 0 {
+			hlen += 8
+		}
+	case gre.SeqPresent:
+		// Type II has an 8-byte header with a version number
+		hlen = 8
+		if len(payload) >= hlen && binary.BigEndian.Uint16(payload[0:2])>>12 != 1 {
+			return nil
+		}
+	default:
+		// Type I has no header at all
+	}
+	if len(payload) < hlen {
+		return nil
+	}
+	return payload[hlen:]
+}
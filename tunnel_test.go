@@ -0,0 +1,171 @@
+package netshovel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// encapsulate wraps payload in some outer layers, returning an Ethernet packet
+func encapsulate(t *testing.T, when time.Time, payload []byte, outer ...gopacket.SerializableLayer) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ls := append([]gopacket.SerializableLayer{eth}, outer...)
+	ls = append(ls, gopacket.Payload(payload))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = when
+	packet.Metadata().CaptureLength = len(buf.Bytes())
+	packet.Metadata().Length = len(buf.Bytes())
+	return packet
+}
+
+// outerIPv4 returns an IPv4 header for the outside of a tunnel
+func outerIPv4(proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: proto,
+		SrcIP:    net.ParseIP("192.0.2.1"),
+		DstIP:    net.ParseIP("192.0.2.2"),
+	}
+}
+
+// outerUDP returns IPv4 and UDP headers for the outside of a tunnel
+func outerUDP(port layers.UDPPort) (*layers.IPv4, *layers.UDP) {
+	ip := outerIPv4(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 50000, DstPort: port}
+	udp.SetNetworkLayerForChecksum(ip)
+	return ip, udp
+}
+
+// tcp6Packet returns the IPv6 packet in an Ethernet/IPv6/TCP packet
+func tcp6Packet(t *testing.T, sport int, payload []byte) []byte {
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolTCP,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(sport),
+		DstPort: 80,
+		Seq:     100,
+		Window:  1024,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecapsulation(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	inner := func(sport int) []byte {
+		// Just the IPv4 packet
+		return tcpPacket(t, when, "10.0.0.1", "10.0.0.2", sport, 80, 100, false, []byte("hello")).Data()[14:]
+	}
+	frame := func(sport int) []byte {
+		return tcpPacket(t, when, "10.0.0.1", "10.0.0.2", sport, 80, 100, false, []byte("hello")).Data()
+	}
+
+	vxlanIP, vxlanUDP := outerUDP(4789)
+	gtpIP, gtpUDP := outerUDP(2152)
+	erspan := append([]byte{0x10, 0, 0, 1, 0, 0, 0, 0}, frame(1005)...)
+
+	packets := map[int]gopacket.Packet{
+		1001: encapsulate(t, when, inner(1001), outerIPv4(layers.IPProtocolGRE), &layers.GRE{Protocol: layers.EthernetTypeIPv4}),
+		1002: encapsulate(t, when, frame(1002), vxlanIP, vxlanUDP, &layers.VXLAN{ValidIDFlag: true, VNI: 42}),
+		1003: encapsulate(t, when, inner(1003), gtpIP, gtpUDP, &layers.GTPv1U{Version: 1, ProtocolType: 1, MessageType: 255, TEID: 7}),
+		1004: encapsulate(t, when, inner(1004), outerIPv4(layers.IPProtocolIPv4)),
+		1005: encapsulate(t, when, erspan, outerIPv4(layers.IPProtocolGRE), &layers.GRE{Protocol: ethernetTypeERSPAN, SeqPresent: true}),
+		1006: encapsulate(t, when, tcp6Packet(t, 1006, []byte("hello")), outerIPv4(layers.IPProtocolIPv6)),
+	}
+	expected := map[int]Tunnel{
+		1001: TunnelGRE,
+		1002: TunnelVXLAN,
+		1003: TunnelGTPU,
+		1004: TunnelIPinIP,
+		1005: TunnelERSPAN,
+		1006: Tunnel6in4,
+	}
+
+	outerFlow := outerIPv4(0)
+	outerNet := gopacket.NewFlow(layers.EndpointIPv4, outerFlow.SrcIP.To4(), outerFlow.DstIP.To4())
+	for sport, packet := range packets {
+		factory := &testStreamFactory{streams: make(chan *Stream, 10)}
+		assembler := NewAssembler(factory)
+		source := PacketSlice{packet}
+		if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+			t.Fatal(err)
+		}
+		assembler.FlushAll()
+
+		if len(factory.streams) != 1 {
+			t.Errorf("%v: %d streams", expected[sport], len(factory.streams))
+			continue
+		}
+		stream := <-factory.streams
+		if stream.Transport.Src() != layers.NewTCPPortEndpoint(layers.TCPPort(sport)) {
+			t.Errorf("%v: wrong transport %v", expected[sport], stream.Transport)
+		}
+		if len(stream.Tunnels) != 1 || stream.Tunnels[0].Tunnel != expected[sport] || stream.Tunnels[0].Net != outerNet {
+			t.Errorf("%v: wrong tunnels %v", expected[sport], stream.Tunnels)
+		}
+		u, err := stream.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Data.String("") != "hello" {
+			t.Errorf("%v: wrong data %q", expected[sport], u.Data.String(""))
+		}
+
+		// Now try again, without unwrapping that kind of tunnel
+		factory = &testStreamFactory{streams: make(chan *Stream, 10)}
+		assembler = NewAssembler(factory)
+		assembler.Tunnels &^= expected[sport]
+		source = PacketSlice{packet}
+		ShovelSource(context.Background(), &source, assembler)
+		assembler.FlushAll()
+		if len(factory.streams) != 0 {
+			t.Errorf("%v: unwrapped when it shouldn't have been", expected[sport])
+		}
+	}
+}
+
+func TestTunnelFlag(t *testing.T) {
+	var tunnels Tunnel
+	if err := tunnels.Set("gre, VXLAN,6in4"); err != nil {
+		t.Fatal(err)
+	}
+	if tunnels != TunnelGRE|TunnelVXLAN|Tunnel6in4 {
+		t.Errorf("Wrong tunnels: %v", tunnels)
+	}
+	if tunnels.String() != "gre,vxlan,6in4" {
+		t.Errorf("Wrong string: %s", tunnels.String())
+	}
+	if err := tunnels.Set("all"); err != nil || tunnels != AllTunnels {
+		t.Errorf("Wrong tunnels: %v %v", tunnels, err)
+	}
+	if err := tunnels.Set("mpls"); err == nil {
+		t.Error("Unknown tunnel type accepted")
+	}
+}
@@ -0,0 +1,98 @@
+package netshovel
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// UDPIdleTimeout is how long a UDP flow may go without a datagram before it's considered finished
+//
+// UDP has no way to say a conversation is over,
+// so a flow which picks up again after this long
+// gets a new Stream.
+var UDPIdleTimeout = 1 * time.Minute
+
+// A UDPStream receives the datagrams of one half of a UDP flow
+//
+// *Stream implements this,
+// delivering each datagram to your decoder as an Utterance.
+type UDPStream interface {
+	Datagram(when time.Time, payload []byte) // Called with each datagram
+	ReassemblyComplete()                     // Called when the flow is finished
+}
+
+// A UDPStreamFactory makes UDPStreams
+//
+// This parallels tcpassembly.StreamFactory.
+// If your StreamFactory also has this NewUDP method,
+// Shovel will send it UDP flows as well as TCP streams,
+// and your decoder can Read them just the same.
+type UDPStreamFactory interface {
+	NewUDP(net, transport gopacket.Flow) UDPStream
+}
+
+// flowKey identifies one direction of a TCP or UDP flow
+type flowKey struct {
+	net, transport gopacket.Flow
+}
+
+// A udpFlow is a UDP flow we're keeping track of
+type udpFlow struct {
+	stream UDPStream
+	last   time.Time // When the last datagram showed up
+}
+
+// udpTracker groups UDP datagrams into flows
+type udpTracker struct {
+	flows     map[flowKey]*udpFlow
+	lastSweep time.Time
+}
+
+// trackUDP sends a UDP datagram to the stream for its flow, making one if needed
+func (a *Assembler) trackUDP(net gopacket.NetworkLayer, udp *layers.UDP, when time.Time) {
+	t := &a.udp
+	if t.flows == nil {
+		t.flows = make(map[flowKey]*udpFlow)
+		t.lastSweep = when
+	}
+
+	// Flows are only swept every so often, so they don't get checked on every packet
+	a.closing = ClosedIdle
+	defer func() { a.closing = StillOpen }()
+	if when.Sub(t.lastSweep) > UDPIdleTimeout {
+		a.flushUDP(when.Add(-UDPIdleTimeout))
+		t.lastSweep = when
+	}
+
+	key := flowKey{net.NetworkFlow(), udp.TransportFlow()}
+	flow := t.flows[key]
+	if flow != nil && when.Sub(flow.last) > UDPIdleTimeout {
+		flow.stream.ReassemblyComplete()
+		flow = nil
+	}
+	if flow == nil {
+		flow = &udpFlow{stream: a.UDPFactory.NewUDP(key.net, key.transport)}
+		if st, ok := flow.stream.(streamer); ok {
+			st.netshovelStream().attach(a)
+		}
+		t.flows[key] = flow
+	}
+	flow.last = when
+	flow.stream.Datagram(when, udp.Payload)
+}
+
+// flushUDP finishes every UDP flow which hasn't seen a datagram since t
+//
+// If t is zero, every flow is finished.
+func (a *Assembler) flushUDP(t time.Time) (closed int) {
+	for key, flow := range a.udp.flows {
+		if t.IsZero() || flow.last.Before(t) {
+			flow.stream.ReassemblyComplete()
+			delete(a.udp.flows, key)
+			closed++
+		}
+	}
+	return closed
+}
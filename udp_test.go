@@ -0,0 +1,91 @@
+package netshovel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// udpPacket builds an Ethernet/IPv4/UDP packet from src:sport to dst:dport
+func udpPacket(t *testing.T, when time.Time, src, dst string, sport, dport int, payload []byte) gopacket.Packet {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP(dst),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(sport),
+		DstPort: layers.UDPPort(dport),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	return encapsulate(t, when, payload, ip, udp)
+}
+
+// testUDPStreamFactory makes Streams for TCP and UDP, and remembers them
+type testUDPStreamFactory struct {
+	testStreamFactory
+}
+
+func (f *testUDPStreamFactory) NewUDP(net, transport gopacket.Flow) UDPStream {
+	stream := NewStream(net, transport)
+	f.streams <- stream
+	return stream
+}
+
+func TestUDP(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	later := when.Add(UDPIdleTimeout * 2)
+	source := PacketSlice{
+		udpPacket(t, when, "10.0.0.1", "10.0.0.2", 5353, 53, []byte("question")),
+		udpPacket(t, when, "10.0.0.2", "10.0.0.1", 53, 5353, []byte("answer")),
+		udpPacket(t, when.Add(time.Second), "10.0.0.1", "10.0.0.2", 5353, 53, []byte("again")),
+		udpPacket(t, later, "10.0.0.1", "10.0.0.2", 5353, 53, []byte("much later")),
+	}
+
+	factory := &testUDPStreamFactory{testStreamFactory{streams: make(chan *Stream, 10)}}
+	assembler := NewAssembler(factory)
+	if err := ShovelSource(context.Background(), &source, assembler); err != nil {
+		t.Fatal(err)
+	}
+	assembler.FlushAll()
+
+	expected := [][]string{
+		{"question", "again"},
+		{"answer"},
+		{"much later"},
+	}
+	if len(factory.streams) != len(expected) {
+		t.Fatalf("Got %d streams", len(factory.streams))
+	}
+	for i, datagrams := range expected {
+		stream := <-factory.streams
+		for _, d := range datagrams {
+			u, err := stream.Read(-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Data.String("") != d {
+				t.Errorf("Stream %d: wrong datagram %q", i, u.Data.String(""))
+			}
+		}
+		if _, err := stream.Read(-1); err == nil {
+			t.Errorf("Stream %d: too many datagrams", i)
+		}
+	}
+
+	// Without a UDPStreamFactory, UDP is ignored
+	tcpOnly := &testStreamFactory{streams: make(chan *Stream, 10)}
+	assembler = NewAssembler(tcpOnly)
+	source = PacketSlice{udpPacket(t, when, "10.0.0.1", "10.0.0.2", 5353, 53, []byte("question"))}
+	ShovelSource(context.Background(), &source, assembler)
+	assembler.FlushAll()
+	if len(tcpOnly.streams) != 0 {
+		t.Error("UDP went to a TCP-only factory")
+	}
+}